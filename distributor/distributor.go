@@ -12,32 +12,309 @@ package main
 
 import (
 	"github.com/zorkian/distributor/torrent"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var CTORRENT string = "/usr/local/bin/ctorrent"
+// parsePortRange parses a range like "6881-6999". A single port is a range of one.
+func parsePortRange(spec string) (int, int, error) {
+	pieces := strings.SplitN(spec, "-", 2)
+	min, err := strconv.Atoi(pieces[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	max := min
+	if len(pieces) == 2 {
+		if max, err = strconv.Atoi(pieces[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	return min, max, nil
+}
+
+// parseSize parses a size in bytes, optionally with a K, M or G suffix in either case, like
+// "256K" or "256k".
+func parseSize(spec string) (int64, error) {
+	multiplier := int64(1)
+	switch upper := strings.ToUpper(spec); {
+	case strings.HasSuffix(upper, "G"):
+		multiplier, spec = 1024*1024*1024, spec[:len(spec)-1]
+	case strings.HasSuffix(upper, "K"):
+		multiplier, spec = 1024, spec[:len(spec)-1]
+	case strings.HasSuffix(upper, "M"):
+		multiplier, spec = 1024*1024, spec[:len(spec)-1]
+	}
+	size, err := strconv.ParseInt(spec, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * multiplier, nil
+}
+
+// parseDirSizes parses a list of per-directory sizes like "isos=16M,small/files=16K".
+func parseDirSizes(spec string) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	for _, entry := range strings.Split(spec, ",") {
+		pieces := strings.SplitN(entry, "=", 2)
+		if len(pieces) != 2 {
+			return nil, errors.New(fmt.Sprintf("expected dir=size, got %q", entry))
+		}
+		size, err := parseSize(pieces[1])
+		if err != nil {
+			return nil, err
+		}
+		sizes[pieces[0]] = size
+	}
+	return sizes, nil
+}
+
+// listFlag is a flag that can be given more than once.
+type listFlag []string
+
+func (self *listFlag) String() string {
+	return strings.Join(*self, " ")
+}
+
+func (self *listFlag) Set(value string) error {
+	*self = append(*self, value)
+	return nil
+}
+
+// rootFlags are the flags that pick which files are served, and how changes to them are found.
+// Each can be given more than once, and each value can start with the name of a root and a
+// colon, like "pkgs:*.lock", to apply only to that root.
+type rootFlags struct {
+	include, exclude, includeRegexp, excludeRegexp listFlag
+	minSize, maxSize, symlinks, pollInterval       listFlag
+}
+
+// splitRoot splits a root flag's value into the root it's for and the rest. Values that don't
+// start with the name of one of roots are for every root.
+func splitRoot(value string, roots map[string]string) (string, string) {
+	if idx := strings.Index(value, ":"); idx > 0 {
+		if _, ok := roots[value[:idx]]; ok {
+			return value[:idx], value[idx+1:]
+		}
+	}
+	return "", value
+}
+
+// options adds the flags for the root called name to options. The flags for every root come
+// first, so ones for the root itself add to their patterns or override their other settings.
+// With name "", only the flags for every root are added.
+func (self *rootFlags) options(name string, roots map[string]string,
+	options torrent.WatcherOptions) (torrent.WatcherOptions, error) {
+	options.ExcludeGlobs = append([]string{}, options.ExcludeGlobs...)
+	for _, scoped := range []bool{false, true} {
+		apply := func(values listFlag, set func(value string) error) error {
+			for _, value := range values {
+				root, value := splitRoot(value, roots)
+				if (root != "") == scoped && (root == "" || root == name) {
+					if err := set(value); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+
+		err := apply(self.include, func(value string) error {
+			options.IncludeGlobs = append(options.IncludeGlobs, value)
+			return nil
+		})
+		if err == nil {
+			err = apply(self.exclude, func(value string) error {
+				options.ExcludeGlobs = append(options.ExcludeGlobs, value)
+				return nil
+			})
+		}
+		if err == nil {
+			err = apply(self.includeRegexp, func(value string) error {
+				re, err := regexp.Compile(value)
+				options.IncludeRegexps = append(options.IncludeRegexps, re)
+				return err
+			})
+		}
+		if err == nil {
+			err = apply(self.excludeRegexp, func(value string) error {
+				re, err := regexp.Compile(value)
+				options.ExcludeRegexps = append(options.ExcludeRegexps, re)
+				return err
+			})
+		}
+		if err == nil {
+			err = apply(self.minSize, func(value string) (err error) {
+				options.MinSize, err = parseSize(value)
+				return err
+			})
+		}
+		if err == nil {
+			err = apply(self.maxSize, func(value string) (err error) {
+				options.MaxSize, err = parseSize(value)
+				return err
+			})
+		}
+		if err == nil {
+			err = apply(self.symlinks, func(value string) error {
+				if value != "follow" && value != "skip" {
+					return errors.New(fmt.Sprintf("-symlinks must be follow or skip, not %q",
+						value))
+				}
+				options.SkipSymlinks = value == "skip"
+				return nil
+			})
+		}
+		if err == nil {
+			err = apply(self.pollInterval, func(value string) (err error) {
+				options.PollInterval, err = time.ParseDuration(value)
+				return err
+			})
+		}
+		if err != nil {
+			return options, err
+		}
+	}
+	return options, nil
+}
+
+// parseRoots parses the directories to serve, like "images=/srv/images,pkgs=/srv/pkgs". A
+// directory without a name is named after its last component.
+func parseRoots(spec string) (map[string]string, error) {
+	roots := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		name, dir := "", entry
+		if pieces := strings.SplitN(entry, "=", 2); len(pieces) == 2 {
+			name, dir = pieces[0], pieces[1]
+		}
+		if dir == "" {
+			return nil, errors.New(fmt.Sprintf("expected name=dir, got %q", entry))
+		}
+		dir = filepath.Clean(dir) // Canonicalize.
+		if name == "" {
+			name = filepath.Base(dir)
+		}
+		if _, ok := roots[name]; ok {
+			return nil, errors.New(fmt.Sprintf("two directories named %s", name))
+		}
+		roots[name] = dir
+	}
+	return roots, nil
+}
 
 func main() {
 	verbose := flag.Bool("verbose", false, "Verbose mode (extra output)")
 	debug := flag.Bool("debug", false, "Extra verbose (debugging output)")
 	listen := flag.String("listen", "127.0.0.1", "IP address to bind to for serving")
 	port := flag.Int("port", 6390, "Port to serve tracker/torrents on")
-	dir := flag.String("serve", "/var/www", "Directory to serve files from")
-	ctorrent := flag.String("ctorrent", CTORRENT, "Path to ctorrent binary")
+	serve := flag.String("serve", "/var/www",
+		"Directory to serve files from, or several as name=dir,name=dir")
+	seederName := flag.String("seeder", "native", "How to seed files: native, ctorrent or none")
+	ctorrent := flag.String("ctorrent", "/usr/local/bin/ctorrent",
+		"Path to ctorrent binary (implies -seeder=ctorrent)")
+	seedDuration := flag.Duration("seed-duration", torrent.SEED_DURATION, "How long each seed runs")
+	seedPorts := flag.String("seed-ports", "",
+		"Port range for seeds, e.g. 6881-6999 (default: any free port)")
+	maxSeeds := flag.Int("max-seeds", 0,
+		"Most files to seed at once; least recently requested is stopped (0: no limit)")
+	eagerSeed := flag.Bool("eager-seed", false,
+		"Seed every file as soon as its metadata is ready instead of on first request")
+	torrentVersion := flag.String("torrent-version", "v1",
+		"Torrent format to generate: v1, v2 (SHA-256 merkle trees) or hybrid")
+	hashWorkers := flag.Int("hash-workers", 0,
+		"Goroutines hashing each file's pieces (0: one per CPU)")
+	hashConcurrency := flag.Int("hash-concurrency", torrent.HASH_CONCURRENCY,
+		"Files to generate metadata for at once")
+	pieceLength := flag.String("piece-length", "",
+		"Piece length, e.g. 256K (default: picked from each file's size)")
+	dirPieceLengths := flag.String("dir-piece-length", "",
+		"Piece lengths for subdirectories of -serve, e.g. isos=16M,small=16K")
+	cacheDir := flag.String("cache-dir", "",
+		"Directory for hash caches (default: next to each file, in -serve)")
+	settleTime := flag.Duration("settle-time", 0,
+		"How long files must go unchanged before they're published (0: straight away)")
+	stagingSuffixes := flag.String("staging-suffixes", "",
+		"Only publish new files renamed into place from these suffixes, e.g. .part,.tmp")
+	var perRoot rootFlags
+	flag.Var(&perRoot.include, "include",
+		"Only serve files matching this glob (may be repeated; prefix with root: for one root)")
+	flag.Var(&perRoot.exclude, "exclude",
+		"Don't serve files or directories matching this glob (hidden ones are never served)")
+	flag.Var(&perRoot.includeRegexp, "include-regexp",
+		"Only serve files whose path in their root matches this regexp")
+	flag.Var(&perRoot.excludeRegexp, "exclude-regexp",
+		"Don't serve files or directories whose path in their root matches this regexp")
+	flag.Var(&perRoot.minSize, "min-size", "Don't serve files smaller than this, e.g. 1K")
+	flag.Var(&perRoot.maxSize, "max-size", "Don't serve files larger than this, e.g. 10G")
+	flag.Var(&perRoot.symlinks, "symlinks", "Whether to follow or skip symlinks (default follow)")
+	flag.Var(&perRoot.pollInterval, "poll-interval",
+		"Scan for changes this often instead of using inotify, e.g. nfs:30s (default: don't)")
+	udpPort := flag.Int("udp-port", 0,
+		"Port for the UDP tracker (0: same as -port, -1: no UDP tracker)")
+	topology := flag.String("topology", "",
+		"File mapping CIDR blocks to datacenter, row and rack, for handing out nearby peers")
+	remoteFraction := flag.Float64("remote-fraction", torrent.DEFAULT_REMOTE_FRACTION,
+		"Fraction of the peers of remote fetchers that are in other datacenters (with -topology)")
+	selectorName := flag.String("peer-selector", "",
+		"How to pick peers: random, topology, seeders or least-recent "+
+			"(default: topology with -topology, otherwise random)")
+	numwant := flag.Int("numwant", torrent.DEFAULT_NUMWANT,
+		"Peers to hand out when the client doesn't say how many it wants")
+	maxNumwant := flag.Int("max-numwant", torrent.MAX_NUMWANT, "Most peers to hand out")
+	peerTTL := flag.Duration("peer-ttl", torrent.PEER_TIMEOUT,
+		"Drop peers that haven't announced for this long")
+	reapInterval := flag.Duration("reap-interval", torrent.REAP_INTERVAL,
+		"How often to look for peers to drop")
+	stateFile := flag.String("state-file", "",
+		"Save the tracker's swarms here, to have peers to hand out straight after a restart")
+	saveInterval := flag.Duration("save-interval", torrent.SAVE_INTERVAL,
+		"How often to save the tracker's swarms (with -state-file)")
+	clusterMembers := flag.String("cluster", "",
+		"Other distributors to share swarms with, as comma-separated host:port")
+	clusterSecretFile := flag.String("cluster-secret-file", "",
+		"File holding the secret that cluster members sign their requests with")
+	clusterSyncInterval := flag.Duration("cluster-sync-interval", torrent.CLUSTER_SYNC_INTERVAL,
+		"How often to send announces to the other cluster members")
+	adminTokenFile := flag.String("admin-token-file", "",
+		"File holding the token for the /admin endpoints, which are off without one")
+	whitelist := flag.String("whitelist", "",
+		"File of hex info_hashes, one per line, of other torrents to track besides our own")
 	flag.Parse()
 
-	info, err := os.Stat(*dir)
+	// Older setups only pass -ctorrent, so honor that if -seeder wasn't given. If it was, the
+	// two had better agree.
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if given["ctorrent"] {
+		if !given["seeder"] {
+			*seederName = "ctorrent"
+		} else if *seederName != "ctorrent" {
+			torrent.LogFatal("-ctorrent conflicts with -seeder=%s", *seederName)
+		}
+	}
+
+	roots, err := parseRoots(*serve)
 	if err != nil {
-		torrent.LogFatal("-serve does not exist: %s", err)
+		torrent.LogFatal("-serve: %s", err)
 	}
-	if !info.IsDir() {
-		torrent.LogFatal("-serve is not a directory")
+	var dir string
+	for _, dir = range roots {
+		info, err := os.Stat(dir)
+		if err != nil {
+			torrent.LogFatal("-serve does not exist: %s", err)
+		}
+		if !info.IsDir() {
+			torrent.LogFatal("-serve %s is not a directory", dir)
+		}
 	}
-	*dir = filepath.Clean(*dir) // Canonicalize.
 	verbosity := torrent.VerbNormal
 	if *debug {
 		verbosity = torrent.VerbDebug
@@ -45,7 +322,146 @@ func main() {
 		verbosity = torrent.VerbVerbose
 	}
 
-	distributor, err := torrent.NewDistributor(*dir, *ctorrent, *listen, *port, verbosity)
+	var seeder torrent.Seeder
+	switch *seederName {
+	case "native":
+		seeder = torrent.NewNativeSeeder()
+	case "ctorrent":
+		seeder, err = torrent.NewCtorrentSeeder(*ctorrent)
+		if err != nil {
+			torrent.LogFatal("-ctorrent: %s", err)
+		}
+	case "none":
+		seeder = torrent.NullSeeder{}
+	default:
+		torrent.LogFatal("-seeder must be one of native, ctorrent or none")
+	}
+
+	policy := torrent.SeedPolicy{
+		Duration: *seedDuration,
+		MaxSeeds: *maxSeeds,
+		Eager:    *eagerSeed,
+	}
+	if *seedPorts != "" {
+		policy.MinPort, policy.MaxPort, err = parsePortRange(*seedPorts)
+		if err != nil {
+			torrent.LogFatal("-seed-ports: %s", err)
+		}
+		if policy.MaxSeeds == 0 {
+			// Every seed needs its own port, so the range is a natural limit.
+			policy.MaxSeeds = policy.MaxPort - policy.MinPort + 1
+		}
+	}
+
+	mdoptions := torrent.DefaultMetadataOptions
+	switch *torrentVersion {
+	case "v1":
+		mdoptions.Version = torrent.TorrentV1
+	case "v2":
+		mdoptions.Version = torrent.TorrentV2
+	case "hybrid":
+		mdoptions.Version = torrent.TorrentHybrid
+	default:
+		torrent.LogFatal("-torrent-version must be one of v1, v2 or hybrid")
+	}
+	mdoptions.HashWorkers = *hashWorkers
+	mdoptions.Concurrency = *hashConcurrency
+	mdoptions.CacheDir = *cacheDir
+	if *pieceLength != "" {
+		if mdoptions.PieceLength, err = parseSize(*pieceLength); err != nil {
+			torrent.LogFatal("-piece-length: %s", err)
+		}
+	}
+	if *dirPieceLengths != "" {
+		if mdoptions.DirPieceLengths, err = parseDirSizes(*dirPieceLengths); err != nil {
+			torrent.LogFatal("-dir-piece-length: %s", err)
+		}
+	}
+
+	woptions := torrent.DefaultWatcherOptions
+	woptions.SettleTime = *settleTime
+	if *stagingSuffixes != "" {
+		woptions.StagingSuffixes = strings.Split(*stagingSuffixes, ",")
+	}
+
+	toptions := torrent.DefaultTrackerOptions
+	toptions.UDPPort = *udpPort
+	toptions.DefaultNumWant = *numwant
+	toptions.MaxNumWant = *maxNumwant
+	toptions.PeerTTL = *peerTTL
+	toptions.ReapInterval = *reapInterval
+	toptions.StateFile = *stateFile
+	toptions.SaveInterval = *saveInterval
+	if *clusterMembers != "" {
+		toptions.ClusterMembers = strings.Split(*clusterMembers, ",")
+		toptions.ClusterSyncInterval = *clusterSyncInterval
+		if *clusterSecretFile == "" {
+			torrent.LogFatal("-cluster needs -cluster-secret-file")
+		}
+		secret, err := ioutil.ReadFile(*clusterSecretFile)
+		if err != nil {
+			torrent.LogFatal("-cluster-secret-file: %s", err)
+		}
+		toptions.ClusterSecret = strings.TrimSpace(string(secret))
+	}
+	if *adminTokenFile != "" {
+		token, err := ioutil.ReadFile(*adminTokenFile)
+		if err != nil {
+			torrent.LogFatal("-admin-token-file: %s", err)
+		}
+		if toptions.AdminToken = strings.TrimSpace(string(token)); toptions.AdminToken == "" {
+			torrent.LogFatal("-admin-token-file is empty")
+		}
+	}
+	if *whitelist != "" {
+		if toptions.Whitelist, err = torrent.LoadWhitelist(*whitelist); err != nil {
+			torrent.LogFatal("-whitelist: %s", err)
+		}
+	}
+	var peerTopology *torrent.Topology
+	if *topology != "" {
+		if peerTopology, err = torrent.LoadTopology(*topology); err != nil {
+			torrent.LogFatal("-topology: %s", err)
+		}
+		if *selectorName == "" {
+			*selectorName = "topology"
+		}
+	}
+	if *selectorName == "" {
+		*selectorName = "random"
+	}
+	toptions.Selector, err = torrent.NewPeerSelector(*selectorName, peerTopology,
+		*remoteFraction)
+	if err != nil {
+		torrent.LogFatal("-peer-selector: %s", err)
+	}
+
+	distributor, err := torrent.NewDistributor(dir, seeder, *listen, *port, verbosity)
+	if err == nil {
+		err = distributor.SetRoots(roots)
+	}
+	if err == nil {
+		err = distributor.SetSeedPolicy(policy)
+	}
+	if err == nil {
+		err = distributor.SetMetadataOptions(mdoptions)
+	}
+	if err == nil {
+		var options torrent.WatcherOptions
+		if options, err = perRoot.options("", roots, woptions); err == nil {
+			err = distributor.SetWatcherOptions(options)
+		}
+		for name := range roots {
+			if err == nil {
+				if options, err = perRoot.options(name, roots, woptions); err == nil {
+					err = distributor.SetRootOptions(name, options)
+				}
+			}
+		}
+	}
+	if err == nil {
+		err = distributor.SetTrackerOptions(toptions)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error Creating distributor: %v\n", err)
 		os.Exit(1)
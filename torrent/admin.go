@@ -0,0 +1,72 @@
+/*
+ * admin.go
+ *
+ * HTTP endpoints for changing a running distributor. They're only served if an admin token is
+ * set, and clients have to send it as "Authorization: Bearer <token>".
+ *
+ *     GET    /admin/roots                        JSON object of the directories served, by name
+ *     POST   /admin/roots?name=pkgs&dir=/srv/pkgs  start serving a directory
+ *     DELETE /admin/roots?name=pkgs              stop serving one
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// checkAdmin makes sure a request comes with our admin token. If it doesn't, an error has
+// been sent and false is returned.
+func (dist *Distributor) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if dist.toptions.AdminToken == "" ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(dist.toptions.AdminToken)) != 1 {
+		LogError("Rejected admin request from %s.", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleAdminRoots lists, adds and removes the directories we serve.
+func (dist *Distributor) handleAdminRoots(w http.ResponseWriter, r *http.Request) {
+	if !dist.checkAdmin(w, r) {
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case "GET":
+	case "POST":
+		LogInfo("Admin request from %s to serve %s as %s.", r.RemoteAddr, r.FormValue("dir"),
+			r.FormValue("name"))
+		err = dist.AddRoot(r.FormValue("name"), r.FormValue("dir"))
+	case "DELETE":
+		LogInfo("Admin request from %s to stop serving %s.", r.RemoteAddr, r.FormValue("name"))
+		err = dist.RemoveRoot(r.FormValue("name"))
+	default:
+		http.Error(w, "GET, POST or DELETE only", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := err.(noRootError); ok || os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dist.Roots()); err != nil {
+		LogError("Failed to encode roots: %s", err)
+	}
+}
@@ -0,0 +1,238 @@
+/*
+ * cache.go
+ *
+ * Caches of piece hashes, stored next to each file (or in a separate cache directory) so we
+ * don't have to rehash everything on restart. Each cache starts with a header describing
+ * exactly which file (size, mtime, inode) and which hashing parameters it's for, and ends with
+ * a checksum of the whole thing. Any mismatch means the cache is ignored and rebuilt.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Suffixes of our cache files, for v1 and v2 hashes.
+const (
+	CACHE_SUFFIX_V1 = ".mdcache"
+	CACHE_SUFFIX_V2 = ".mdcache-v2"
+)
+
+// Version of the cache format. Bump this whenever the layout or meaning of a cache changes.
+const CACHE_VERSION = 1
+
+// Every cache file starts with this.
+var cacheMagic = [4]byte{'D', 'S', 'M', 'C'}
+
+// cacheAlgorithm identifies the hashes stored in a cache.
+type cacheAlgorithm uint8
+
+const (
+	cacheSHA1   = cacheAlgorithm(1) // v1 piece hashes.
+	cacheSHA256 = cacheAlgorithm(2) // v2 piece layer, or the pieces root for small files.
+)
+
+// size returns the length of one hash.
+func (self cacheAlgorithm) size() int {
+	if self == cacheSHA256 {
+		return sha256.Size
+	}
+	return sha1.Size
+}
+
+// cacheHeader is the start of every cache file, stored big-endian.
+type cacheHeader struct {
+	Magic       [4]byte
+	Version     uint16
+	Algorithm   cacheAlgorithm
+	_           uint8
+	PieceLength int64
+	Size        int64  // Size of the file the hashes are for.
+	ModTime     int64  // Its mtime, in nanoseconds.
+	Inode       uint64 // Its inode, so replacing the file with another is noticed.
+	Count       uint32 // Number of hashes that follow.
+}
+
+// The checksum at the end of a cache covers everything before it.
+var cacheChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// isCacheFile returns whether a filename is one of our metadata caches.
+func isCacheFile(name string) bool {
+	return strings.HasSuffix(name, CACHE_SUFFIX_V1) || strings.HasSuffix(name, CACHE_SUFFIX_V2)
+}
+
+// cacheKey turns a path into a file name for CacheDir.
+func cacheKey(path string) string {
+	hash := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(hash[:16])
+}
+
+// cacheRootDir returns the directory in CacheDir that holds the caches for files under the
+// watched directory.
+func (self MetadataOptions) cacheRootDir() string {
+	return filepath.Join(self.CacheDir, cacheKey(self.cacheRoot))
+}
+
+// cacheFile returns where the cache with the given suffix for a file goes. In CacheDir, it's
+// keyed by the file's path; the header identifies the file itself.
+func (self MetadataOptions) cacheFile(fqfn, suffix string) string {
+	if self.CacheDir == "" {
+		return fqfn + suffix
+	}
+	path := fqfn
+	if self.cacheRoot != "" && strings.HasPrefix(fqfn, self.cacheRoot+"/") {
+		path = fqfn[len(self.cacheRoot)+1:]
+	}
+	return filepath.Join(self.cacheRootDir(), cacheKey(path)+suffix)
+}
+
+// removeCache deletes the caches for a file that's gone.
+func (self MetadataOptions) removeCache(fqfn string) {
+	for _, suffix := range []string{CACHE_SUFFIX_V1, CACHE_SUFFIX_V2} {
+		cache_fqfn := self.cacheFile(fqfn, suffix)
+		if err := os.Remove(cache_fqfn); err == nil {
+			LogDebug("Removed cache %s", cache_fqfn)
+		} else if !os.IsNotExist(err) {
+			LogError("Failed to remove cache %s: %s", cache_fqfn, err)
+		}
+	}
+}
+
+// pruneCacheDir deletes the caches in CacheDir for files under the watched directory that no
+// longer exist, which happens when they're removed while we're not running. files are the
+// paths of the files that do exist, relative to the watched directory.
+func (self MetadataOptions) pruneCacheDir(files []string) {
+	if self.CacheDir == "" {
+		return
+	}
+	keep := make(map[string]bool)
+	for _, path := range files {
+		keep[cacheKey(path)+CACHE_SUFFIX_V1] = true
+		keep[cacheKey(path)+CACHE_SUFFIX_V2] = true
+	}
+
+	entries, err := ioutil.ReadDir(self.cacheRootDir())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if keep[entry.Name()] {
+			continue
+		}
+		cache_fqfn := filepath.Join(self.cacheRootDir(), entry.Name())
+		LogDebug("Pruning stale cache %s", cache_fqfn)
+		if err := os.Remove(cache_fqfn); err != nil {
+			LogError("Failed to remove cache %s: %s", cache_fqfn, err)
+		}
+	}
+}
+
+// newCacheHeader describes the cache for a file hashed with the given parameters.
+func newCacheHeader(info os.FileInfo, pieceLength int64, algorithm cacheAlgorithm,
+	count int) cacheHeader {
+	return cacheHeader{
+		Magic:       cacheMagic,
+		Version:     CACHE_VERSION,
+		Algorithm:   algorithm,
+		PieceLength: pieceLength,
+		Size:        info.Size(),
+		ModTime:     info.ModTime().UnixNano(),
+		Inode:       fileInode(info),
+		Count:       uint32(count),
+	}
+}
+
+// encodeCache builds the contents of a cache file.
+func encodeCache(header cacheHeader, hashes [][]byte) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, header)
+	for _, hash := range hashes {
+		buf.Write(hash)
+	}
+	binary.Write(&buf, binary.BigEndian, crc32.Checksum(buf.Bytes(), cacheChecksumTable))
+	return buf.Bytes()
+}
+
+// decodeCache parses the contents of a cache file and returns the hashes in it, if it's intact
+// and its header matches want exactly.
+func decodeCache(data []byte, want cacheHeader) ([][]byte, error) {
+	headerSize := binary.Size(want)
+	if len(data) < headerSize+4 {
+		return nil, errors.New("too short")
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, cacheChecksumTable) != binary.BigEndian.Uint32(data[len(body):]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	var header cacheHeader
+	if err := binary.Read(bytes.NewReader(body), binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if header != want {
+		return nil, errors.New(fmt.Sprintf("header mismatch: have %+v, want %+v", header, want))
+	}
+
+	hashSize := want.Algorithm.size()
+	body = body[headerSize:]
+	if len(body) != hashSize*int(want.Count) {
+		return nil, errors.New(fmt.Sprintf("expected %d hashes, found %d bytes", want.Count,
+			len(body)))
+	}
+	hashes := make([][]byte, 0, want.Count)
+	for i := 0; i < int(want.Count); i++ {
+		hashes = append(hashes, body[i*hashSize:(i+1)*hashSize])
+	}
+	return hashes, nil
+}
+
+// readCache loads cached hashes for a file, if there is a cache that matches the file as it is
+// now and the hashing parameters. There must be exactly count hashes.
+func readCache(fqfn string, info os.FileInfo, cache_fqfn string, pieceLength int64,
+	algorithm cacheAlgorithm, count int) [][]byte {
+	cache_bytes, err := ioutil.ReadFile(cache_fqfn)
+	if err != nil {
+		return nil
+	}
+	LogDebug("Loaded %d cached bytes from %s.", len(cache_bytes), cache_fqfn)
+
+	hashes, err := decodeCache(cache_bytes,
+		newCacheHeader(info, pieceLength, algorithm, count))
+	if err != nil {
+		LogDebug("Cache invalid for %s, rebuilding: %s", fqfn, err)
+		return nil
+	}
+	return hashes
+}
+
+// writeCache saves the hashes for a file. info must be from before the file was hashed, so
+// that any change while hashing makes the cache invalid.
+func writeCache(cache_fqfn string, info os.FileInfo, pieceLength int64,
+	algorithm cacheAlgorithm, hashes [][]byte) error {
+	header := newCacheHeader(info, pieceLength, algorithm, len(hashes))
+	if err := os.MkdirAll(filepath.Dir(cache_fqfn), 0755); err != nil {
+		LogError("Failed to create cache directory: %s", err)
+		return err
+	}
+	if err := ioutil.WriteFile(cache_fqfn, encodeCache(header, hashes), 0644); err != nil {
+		LogError("Failed to write cache file: %s", err)
+		return err
+	}
+	return nil
+}
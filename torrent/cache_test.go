@@ -0,0 +1,132 @@
+package torrent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fqfn := filepath.Join(dir, "data")
+	assert.Nil(t, ioutil.WriteFile(fqfn, []byte("testing"), 0644))
+	info, err := os.Stat(fqfn)
+	assert.Nil(t, err)
+
+	hashes := [][]byte{bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{2}, 20)}
+	assert.Nil(t, writeCache(fqfn+".mdcache", info, testPieceLength, cacheSHA1, hashes))
+	assert.Equal(t, hashes, readCache(fqfn, info, fqfn+".mdcache", testPieceLength, cacheSHA1, 2))
+
+	assert.Nil(t, readCache(fqfn, info, fqfn+".mdcache", 2*testPieceLength, cacheSHA1, 2),
+		"different piece length")
+	assert.Nil(t, readCache(fqfn, info, fqfn+".mdcache", testPieceLength, cacheSHA256, 2),
+		"different algorithm")
+	assert.Nil(t, readCache(fqfn, info, fqfn+".mdcache", testPieceLength, cacheSHA1, 3),
+		"different count")
+
+	// A rewrite with the same size is caught by the mtime, down to the nanosecond.
+	assert.Nil(t, os.Chtimes(fqfn, time.Now(), info.ModTime().Add(time.Nanosecond)))
+	changed, err := os.Stat(fqfn)
+	assert.Nil(t, err)
+	assert.Nil(t, readCache(fqfn, changed, fqfn+".mdcache", testPieceLength, cacheSHA1, 2))
+
+	// As is replacing the file with another one, through the inode.
+	other := filepath.Join(dir, "other")
+	assert.Nil(t, ioutil.WriteFile(other, []byte("testing"), 0644))
+	assert.Nil(t, os.Chtimes(other, time.Now(), info.ModTime()))
+	assert.Nil(t, os.Rename(other, fqfn))
+	replaced, err := os.Stat(fqfn)
+	assert.Nil(t, err)
+	if fileInode(replaced) != 0 {
+		assert.Nil(t, readCache(fqfn, replaced, fqfn+".mdcache", testPieceLength, cacheSHA1, 2))
+	}
+}
+
+func TestDecodeCacheRejectsCorruption(t *testing.T) {
+	header := cacheHeader{
+		Magic:       cacheMagic,
+		Version:     CACHE_VERSION,
+		Algorithm:   cacheSHA256,
+		PieceLength: testPieceLength,
+		Size:        1000,
+		ModTime:     12345,
+		Inode:       42,
+		Count:       1,
+	}
+	data := encodeCache(header, [][]byte{bytes.Repeat([]byte{7}, 32)})
+	hashes, err := decodeCache(data, header)
+	assert.Nil(t, err)
+	assert.Len(t, hashes, 1)
+
+	for i := range data {
+		corrupt := append([]byte{}, data...)
+		corrupt[i] ^= 0x80
+		_, err := decodeCache(corrupt, header)
+		assert.NotNil(t, err, "byte %d flipped", i)
+	}
+	_, err = decodeCache(data[:10], header)
+	assert.NotNil(t, err)
+
+	// Caches from an older version are rebuilt, not misread.
+	old := header
+	old.Version = CACHE_VERSION - 1
+	_, err = decodeCache(encodeCache(old, [][]byte{bytes.Repeat([]byte{7}, 32)}), header)
+	assert.NotNil(t, err)
+
+	// As are the old raw caches, which were just the hashes.
+	_, err = decodeCache(bytes.Repeat([]byte{7}, 40), header)
+	assert.NotNil(t, err)
+}
+
+func TestCacheDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cacheDir, err := ioutil.TempDir("", "distributor-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(cacheDir)
+
+	fqfn := filepath.Join(dir, "data")
+	assert.Nil(t, ioutil.WriteFile(fqfn, []byte("testing"), 0644))
+	options := MetadataOptions{Version: TorrentHybrid, CacheDir: cacheDir, cacheRoot: dir}
+
+	// The served directory can be read-only.
+	assert.Nil(t, os.Chmod(dir, 0555))
+	defer os.Chmod(dir, 0755)
+	mdinfo, err := GenerateMetadataInfo(fqfn, options)
+	assert.Nil(t, err)
+	assert.NotNil(t, mdinfo)
+
+	v1 := options.cacheFile(fqfn, CACHE_SUFFIX_V1)
+	v2 := options.cacheFile(fqfn, CACHE_SUFFIX_V2)
+	assert.Equal(t, filepath.Join(cacheDir, cacheKey(dir), cacheKey("data")+".mdcache"), v1)
+	_, err = os.Stat(v1)
+	assert.Nil(t, err)
+	_, err = os.Stat(v2)
+	assert.Nil(t, err)
+	_, err = os.Stat(fqfn + CACHE_SUFFIX_V1)
+	assert.True(t, os.IsNotExist(err), "nothing written next to the file")
+
+	// Caches for files that still exist survive pruning, others don't.
+	options.pruneCacheDir([]string{"data"})
+	_, err = os.Stat(v1)
+	assert.Nil(t, err)
+	options.pruneCacheDir(nil)
+	_, err = os.Stat(v1)
+	assert.True(t, os.IsNotExist(err))
+
+	GenerateMetadataInfo(fqfn, options)
+	options.removeCache(fqfn)
+	_, err = os.Stat(v1)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(v2)
+	assert.True(t, os.IsNotExist(err))
+}
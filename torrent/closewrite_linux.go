@@ -0,0 +1,118 @@
+/*
+ * closewrite_linux.go
+ *
+ * Tells the watcher when files are closed after being written, which fsnotify doesn't, so they
+ * can be published without waiting for their SettleTime.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// closeWatcher watches directories, with an inotify instance of its own, for files in them
+// being closed after they were written. Each one is sent to Events with the closeWrite Op.
+type closeWatcher struct {
+	Events chan fsnotify.Event
+	fd     int
+	file   *os.File
+	dirs   map[int32]string // By watch descriptor.
+	done   chan bool
+	lock   sync.Mutex
+}
+
+func newCloseWatcher() (*closeWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	self := &closeWatcher{
+		Events: make(chan fsnotify.Event, 1000),
+		fd:     fd,
+		// Since it's non-blocking, reading it through an os.File waits in the runtime's poller,
+		// and closing the file wakes the reader up.
+		file: os.NewFile(uintptr(fd), "inotify"),
+		dirs: make(map[int32]string),
+		done: make(chan bool),
+	}
+	go self.read()
+	return self, nil
+}
+
+// Add watches the files in dir.
+func (self *closeWatcher) Add(dir string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	select {
+	case <-self.done:
+		return syscall.EBADF
+	default:
+	}
+	wd, err := syscall.InotifyAddWatch(self.fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_ONLYDIR)
+	if err != nil {
+		return err
+	}
+	self.dirs[int32(wd)] = dir
+	return nil
+}
+
+// Close stops watching.
+func (self *closeWatcher) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	select {
+	case <-self.done:
+	default:
+		close(self.done)
+		self.file.Close()
+	}
+}
+
+func (self *closeWatcher) read() {
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+	for {
+		n, err := self.file.Read(buf[:])
+		if err != nil {
+			return // Closed.
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(event.Len)
+			if offset > n {
+				break
+			}
+
+			self.lock.Lock()
+			dir := self.dirs[event.Wd]
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(self.dirs, event.Wd) // The directory's gone.
+			}
+			self.lock.Unlock()
+
+			if event.Mask&syscall.IN_CLOSE_WRITE == 0 || dir == "" || event.Len == 0 {
+				continue
+			}
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+			select {
+			case self.Events <- fsnotify.Event{Name: filepath.Join(dir, name), Op: closeWrite}:
+			case <-self.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcherPublishesClosedFiles(t *testing.T) {
+	dir, watcher, ready := newTestWatcher(t, WatcherOptions{SettleTime: time.Hour})
+	defer os.RemoveAll(dir)
+	defer watcher.Close()
+
+	// A file that's still open waits for the settle time, but one that was closed after being
+	// written doesn't, in the watched directory or under it.
+	open, err := os.Create(filepath.Join(dir, "open"))
+	assert.Nil(t, err)
+	defer open.Close()
+	open.Write([]byte("data"))
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	time.Sleep(100 * time.Millisecond) // For sub to be watched.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sub", "closed"), []byte("data"), 0644))
+	select {
+	case file := <-ready:
+		assert.Equal(t, "closed", file.Name)
+		assert.Equal(t, int64(4), file.Size)
+	case <-time.After(10 * time.Second):
+		t.Fatal("closed file wasn't published")
+	}
+	assert.Equal(t, 0, len(ready), "the open file shouldn't be published")
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+/*
+ * closewrite_other.go
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"errors"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// closeWatcher can't be had outside Linux, so files always wait for their SettleTime.
+type closeWatcher struct {
+	Events chan fsnotify.Event
+}
+
+func newCloseWatcher() (*closeWatcher, error) {
+	return nil, errors.New("closed files can only be watched for on Linux")
+}
+
+func (self *closeWatcher) Add(dir string) error {
+	return nil
+}
+
+func (self *closeWatcher) Close() {
+}
@@ -0,0 +1,317 @@
+/*
+ * cluster.go
+ *
+ * Lets several distributors share their swarms, so any of them can answer announces with the
+ * complete list of peers and losing one doesn't stop downloads. Each member sends the announces
+ * it gets to all of the others every second or so, and a member that's starting up fetches
+ * everyone's swarms from the first member that answers. Requests are signed with a secret the
+ * members share.
+ *
+ * Members are assumed to be set up alike: serving the same files, with the same UDP setup.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How often announces are sent to the other members of the cluster, by default.
+const CLUSTER_SYNC_INTERVAL = 1 * time.Second
+
+// How far apart the clocks of two members may be; requests signed longer ago than this are
+// rejected, so they can't be replayed later.
+const CLUSTER_CLOCK_SKEW = 1 * time.Minute
+
+// Most we read of a request from another member.
+const CLUSTER_MAX_REQUEST = 64 << 20
+
+// Headers that sign requests between members.
+const (
+	clusterNodeHeader      = "X-Distributor-Node"
+	clusterTimeHeader      = "X-Distributor-Time"
+	clusterSignatureHeader = "X-Distributor-Signature"
+)
+
+// clusterUpdate is an announce, as sent to the other members.
+type clusterUpdate struct {
+	InfoHash string
+	Peer     Peer
+	Event    string
+	Seen     time.Time
+}
+
+// Returned when a request turns out to have gone to ourselves.
+var errClusterSelf = errors.New("cluster member is us")
+
+// cluster shares a tracker's swarms with the other members of its cluster.
+type cluster struct {
+	tracker *Tracker
+	secret  []byte
+	client  *http.Client
+
+	// members are the other members' HTTP host:port. Any that turn out to be us (the list is
+	// usually the same everywhere) are dropped.
+	lock    sync.Mutex
+	members []string
+	pending []clusterUpdate
+}
+
+func newCluster(tracker *Tracker, members []string, secret string) *cluster {
+	return &cluster{
+		tracker: tracker,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		members: append([]string{}, members...),
+	}
+}
+
+// Members returns the other members of the cluster.
+func (self *cluster) Members() []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return append([]string{}, self.members...)
+}
+
+// forget drops a member, because it's us.
+func (self *cluster) forget(member string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i, tmpMember := range self.members {
+		if tmpMember == member {
+			self.members = append(self.members[:i], self.members[i+1:]...)
+			LogInfo("Cluster member %s is us.", member)
+			return
+		}
+	}
+}
+
+// queue adds an announce to the next batch sent to the other members.
+func (self *cluster) queue(update clusterUpdate) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.members) > 0 {
+		self.pending = append(self.pending, update)
+	}
+}
+
+// sign returns the signature for a request.
+func (self *cluster) sign(node, timestamp, path string, body []byte) string {
+	mac := hmac.New(sha256.New, self.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", node, timestamp, path)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends a signed request to a member and returns the response body.
+func (self *cluster) post(member, path string, body []byte) ([]byte, error) {
+	r, err := http.NewRequest("POST", "http://"+member+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(clusterNodeHeader, self.tracker.trackerId)
+	r.Header.Set(clusterTimeHeader, timestamp)
+	r.Header.Set(clusterSignatureHeader,
+		self.sign(self.tracker.trackerId, timestamp, path, body))
+
+	response, err := self.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusConflict {
+		self.forget(member)
+		return nil, errClusterSelf
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("%s: %s", response.Status, data))
+	}
+	return data, nil
+}
+
+// verify checks a request from another member and returns its body. If it's no good, an
+// error has been sent and nil is returned.
+func (self *cluster) verify(w http.ResponseWriter, r *http.Request) []byte {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return nil
+	}
+	node := r.Header.Get(clusterNodeHeader)
+	if node == self.tracker.trackerId {
+		http.Error(w, "request from ourselves", http.StatusConflict)
+		return nil
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, CLUSTER_MAX_REQUEST))
+	if err != nil {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return nil
+	}
+
+	timestamp := r.Header.Get(clusterTimeHeader)
+	signed, err := strconv.ParseInt(timestamp, 10, 64)
+	skew := time.Since(time.Unix(signed, 0))
+	signature := self.sign(node, timestamp, r.URL.Path, body)
+	if err != nil || skew > CLUSTER_CLOCK_SKEW || skew < -CLUSTER_CLOCK_SKEW ||
+		!hmac.Equal([]byte(signature), []byte(r.Header.Get(clusterSignatureHeader))) {
+		LogError("Rejected cluster request from %s: bad signature or clock skew.", r.RemoteAddr)
+		http.Error(w, "bad signature", http.StatusForbidden)
+		return nil
+	}
+	return body
+}
+
+// flush sends the announces queued since the last flush to every other member, at once.
+// Members that don't get them will hear from the peers again when they next announce.
+func (self *cluster) flush() {
+	self.lock.Lock()
+	updates, members := self.pending, append([]string{}, self.members...)
+	self.pending = nil
+	self.lock.Unlock()
+	if len(updates) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(updates); err != nil {
+		LogError("Failed to encode cluster updates: %s", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, member := range members {
+		wg.Add(1)
+		go func(member string) {
+			defer wg.Done()
+			_, err := self.post(member, "/cluster/sync", buf.Bytes())
+			if err != nil && err != errClusterSelf {
+				LogError("Failed to send %d announces to cluster member %s: %s",
+					len(updates), member, err)
+			}
+		}(member)
+	}
+	wg.Wait()
+}
+
+// handleSync is the endpoint other members send their announces to.
+func (self *cluster) handleSync(w http.ResponseWriter, r *http.Request) {
+	body := self.verify(w, r)
+	if body == nil {
+		return
+	}
+	var updates []clusterUpdate
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&updates); err != nil {
+		http.Error(w, "invalid updates", http.StatusBadRequest)
+		return
+	}
+
+	self.tracker.peerListLock.Lock()
+	defer self.tracker.peerListLock.Unlock()
+	for _, update := range updates {
+		self.tracker.updatePeer(update.InfoHash, &update.Peer, update.Event, update.Seen)
+	}
+	LogDebug("Got %d announces from cluster member %s.", len(updates), r.RemoteAddr)
+}
+
+// handleState is the endpoint members fetch our swarms from when they start.
+func (self *cluster) handleState(w http.ResponseWriter, r *http.Request) {
+	if self.verify(w, r) == nil {
+		return
+	}
+	data, err := self.tracker.encodeState()
+	if err != nil {
+		LogError("Failed to encode tracker state: %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Write(data)
+}
+
+// fetchState gets the swarms from the first member that answers.
+func (self *cluster) fetchState() {
+	for _, member := range self.Members() {
+		data, err := self.post(member, "/cluster/state", nil)
+		if err == errClusterSelf {
+			continue
+		} else if err != nil {
+			LogError("Failed to fetch swarms from cluster member %s: %s", member, err)
+			continue
+		}
+		loaded, err := self.tracker.mergeState(data, time.Now())
+		if err != nil {
+			LogError("Failed to load swarms from cluster member %s: %s", member, err)
+			continue
+		}
+		LogInfo("Loaded %d peers from cluster member %s", loaded, member)
+		return
+	}
+}
+
+// start fetches the swarms from the other members, then sends them our announces every
+// interval until the tracker is closed, and once more then.
+func (self *cluster) start(interval time.Duration) chan bool {
+	if interval <= 0 {
+		interval = CLUSTER_SYNC_INTERVAL
+	}
+	done := make(chan bool)
+
+	go func() {
+		defer close(done)
+		self.fetchState()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				self.flush()
+			case <-self.tracker.quitChan:
+				self.flush()
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// announceURLs returns the HTTP and UDP announce URLs of the other members. Their UDP trackers
+// are assumed to be set up like ours: on their HTTP port if ours is, otherwise on our port.
+func (self *cluster) announceURLs(httpPort int) ([]string, []string) {
+	var httpURLs, udpURLs []string
+	for _, member := range self.Members() {
+		httpURLs = append(httpURLs, fmt.Sprintf("http://%s/announce", member))
+		if self.tracker.udpPort == 0 {
+			continue
+		}
+		host, port, err := net.SplitHostPort(member)
+		if err != nil {
+			continue
+		}
+		if self.tracker.udpPort != httpPort {
+			port = strconv.Itoa(self.tracker.udpPort)
+		}
+		udpURLs = append(udpURLs, fmt.Sprintf("udp://%s/announce", net.JoinHostPort(host, port)))
+	}
+	return httpURLs, udpURLs
+}
@@ -0,0 +1,112 @@
+package torrent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCluster makes a cluster of test trackers, each with an HTTP server for the cluster
+// endpoints. Returns the trackers and their addresses.
+func newTestCluster(t *testing.T, count int, secret string) ([]*Tracker, []string) {
+	var trackers []*Tracker
+	var addrs []string
+	for i := 0; i < count; i++ {
+		tracker := newTestTracker()
+		tracker.trackerId = string('a' + rune(i))
+		mux := http.NewServeMux()
+		mux.HandleFunc("/cluster/sync", func(w http.ResponseWriter, r *http.Request) {
+			tracker.cluster.handleSync(w, r)
+		})
+		mux.HandleFunc("/cluster/state", func(w http.ResponseWriter, r *http.Request) {
+			tracker.cluster.handleState(w, r)
+		})
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		trackers = append(trackers, tracker)
+		addrs = append(addrs, strings.TrimPrefix(server.URL, "http://"))
+	}
+	for _, tracker := range trackers {
+		tracker.cluster = newCluster(tracker, addrs, secret)
+	}
+	return trackers, addrs
+}
+
+func TestClusterSync(t *testing.T) {
+	trackers, _ := newTestCluster(t, 3, "secret")
+	a, b, c := trackers[0], trackers[1], trackers[2]
+
+	announce(t, a, "10.0.0.1:5000", url.Values{"peer_id": {"seed"}, "port": {"1"},
+		"left": {"0"}, "event": {"completed"}})
+	announce(t, b, "10.0.0.2:5000", url.Values{"peer_id": {"leech"}, "port": {"1"}})
+	announce(t, c, "10.0.0.3:5000", url.Values{"peer_id": {"new"}, "port": {"1"}})
+	for _, tracker := range trackers {
+		tracker.cluster.flush()
+	}
+	for _, tracker := range trackers {
+		assert.Len(t, tracker.cluster.Members(), 2, "every member finds itself in the list")
+	}
+
+	response := announce(t, c, "10.0.0.3:5000", url.Values{"peer_id": {"new"}, "port": {"1"}})
+	assert.Len(t, response["peers"], 2, "any member knows every peer")
+	c.cluster.flush()
+	hash := strings.Repeat("i", 20)
+	for _, tracker := range trackers {
+		assert.Equal(t, 1, tracker.Scrape([]string{hash})[hash].Downloaded)
+	}
+
+	announce(t, a, "10.0.0.1:5000", url.Values{"peer_id": {"seed"}, "port": {"1"},
+		"event": {"stopped"}})
+	a.cluster.flush()
+	c.cluster.flush()
+	assert.ElementsMatch(t, []string{"leech", "new"}, peerIds(b.PeerList[hash]))
+
+	// A member that's starting up gets everyone's swarms.
+	joining := newTestTracker()
+	joining.trackerId = "joining"
+	joining.cluster = newCluster(joining, append([]string{"127.0.0.1:1"},
+		a.cluster.Members()...), "secret")
+	joining.cluster.fetchState()
+	assert.ElementsMatch(t, []string{"leech", "new"}, peerIds(joining.PeerList[hash]))
+}
+
+func TestClusterRejectsBadSignatures(t *testing.T) {
+	trackers, addrs := newTestCluster(t, 2, "secret")
+	trackers[0].cluster = newCluster(trackers[0], addrs[1:], "wrong")
+
+	announce(t, trackers[0], "10.0.0.1:5000", url.Values{"peer_id": {"a"}, "port": {"1"}})
+	_, err := trackers[0].cluster.post(addrs[1], "/cluster/sync", []byte("anything"))
+	assert.Contains(t, err.Error(), "403")
+	trackers[0].cluster.flush()
+	assert.Empty(t, trackers[1].PeerList)
+
+	r := httptest.NewRequest("POST", "/cluster/state", nil)
+	w := httptest.NewRecorder()
+	trackers[1].cluster.handleState(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code, "unsigned")
+}
+
+func TestClusterAnnounceList(t *testing.T) {
+	tracker := newTestTracker()
+	tracker.httpPort = 6390
+	tracker.cluster = newCluster(tracker, []string{"other:6390"}, "secret")
+	md := tracker.newMetadata("me:6390", &MetadataInfo{Name: "file"})
+	assert.Equal(t, [][]string{{"http://me:6390/announce", "http://other:6390/announce"}},
+		md.AnnounceList)
+
+	tracker.udpPort = 6390
+	md = tracker.newMetadata("me:6390", &MetadataInfo{Name: "file"})
+	assert.Equal(t, [][]string{
+		{"udp://me:6390/announce", "udp://other:6390/announce"},
+		{"http://me:6390/announce", "http://other:6390/announce"},
+	}, md.AnnounceList)
+
+	tracker.udpPort = 7000
+	md = tracker.newMetadata("me:6390", &MetadataInfo{Name: "file"})
+	assert.Equal(t, []string{"udp://me:7000/announce", "udp://other:7000/announce"},
+		md.AnnounceList[0])
+}
@@ -0,0 +1,219 @@
+/*
+ * command.go
+ *
+ * A Seeder that runs an external BitTorrent client for every file, such as ctorrent.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// CommandArgs builds the command line (binary first) used to seed a file. torrentPath is the
+// location of a .torrent file containing the metadata for the file.
+type CommandArgs func(file *File, torrentPath string, options SeedOptions) []string
+
+// CommandSeeder seeds each file by running an external client. The client is expected to
+// exit on its own at some point; the file gets seeded again the next time it's requested. If
+// the client crashes it is restarted according to Restart.
+type CommandSeeder struct {
+	Duration   time.Duration // Passed to the command as SeedOptions.Duration.
+	Restart    RestartPolicy
+	args       CommandArgs
+	ports      *portPool
+	supervisor *supervisor
+}
+
+// NewCommandSeeder creates a seeder that runs the command built by args for every file. Use
+// this to plug in clients such as aria2c or transmission-cli.
+func NewCommandSeeder(args CommandArgs) *CommandSeeder {
+	return &CommandSeeder{
+		Duration:   SEED_DURATION,
+		Restart:    DefaultRestartPolicy,
+		args:       args,
+		supervisor: newSupervisor(),
+	}
+}
+
+// NewCtorrentSeeder creates a seeder that runs the ctorrent binary at the given path.
+func NewCtorrentSeeder(ctorrentPath string) (*CommandSeeder, error) {
+	if _, err := os.Stat(ctorrentPath); err != nil {
+		LogError("ctorrent binary not found at: %s", ctorrentPath)
+		return nil, errors.New(fmt.Sprintf("ctorrent binary not found at: %s", ctorrentPath))
+	}
+
+	return NewCommandSeeder(func(file *File, torrentPath string, options SeedOptions) []string {
+		// ctorrent counts seeding time in whole hours.
+		hours := int(math.Ceil(options.Duration.Hours()))
+		if hours < 1 {
+			hours = 1
+		}
+		port := options.Port
+		if port == 0 {
+			port = 8999
+		}
+		return []string{
+			ctorrentPath,
+			"-s",
+			file.FQFN,
+			"-e",
+			strconv.Itoa(hours),
+			"-p",
+			strconv.Itoa(port),
+			torrentPath,
+		}
+	}), nil
+}
+
+// SetSeedPolicy makes commands run for the policy's duration on ports from its range. It must
+// be called before any seeds are started.
+func (self *CommandSeeder) SetSeedPolicy(policy SeedPolicy) {
+	self.Duration = policy.Duration
+	self.ports = newPortPool(policy.MinPort, policy.MaxPort)
+}
+
+// writeTorrent writes the metadata out to a temporary .torrent file for the client to read.
+func writeTorrent(file *File, metadata *Metadata) (string, error) {
+	tmp, err := ioutil.TempFile("", "distributor.")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	LogDebug("Temporary file for %s: %s", file.Name, tmp.Name())
+
+	if err = bencode.Marshal(tmp, *metadata); err != nil {
+		os.Remove(tmp.Name())
+		return "", errors.New(fmt.Sprintf("Failed to bencode %s: %s", file.Name, err))
+	}
+	if err = tmp.Sync(); err != nil {
+		os.Remove(tmp.Name())
+		return "", errors.New(fmt.Sprintf("Failed to fsync: %s", err))
+	}
+	return tmp.Name(), nil
+}
+
+// logOutput copies lines from a child's output pipe into our log. The last line is kept in
+// lastLine so a crash can be reported with whatever the child said before dying.
+func logOutput(name string, pipe io.Reader, logger func(string, ...interface{}),
+	lastLine *string, lock *sync.Mutex) {
+	scanner := bufio.NewScanner(pipe)
+	for scanner.Scan() {
+		line := scanner.Text()
+		logger("[%s] %s", name, line)
+		if lastLine != nil && strings.TrimSpace(line) != "" {
+			lock.Lock()
+			*lastLine = line
+			lock.Unlock()
+		}
+	}
+}
+
+// runCommand runs the client for one file until it exits or stop is closed.
+func (self *CommandSeeder) runCommand(file *File, metadata *Metadata, stop chan bool) error {
+	torrentPath, err := writeTorrent(file, metadata)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(torrentPath)
+
+	port, err := self.ports.acquire()
+	if err != nil {
+		return err
+	}
+	defer self.ports.release(port)
+
+	args := self.args(file, torrentPath, SeedOptions{Port: port, Duration: self.Duration})
+	cmd := exec.Command(args[0], args[1:]...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// The pipes have to be drained before Wait, or the child blocks once they fill up.
+	var lastLine string
+	var lastLineLock sync.Mutex
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		logOutput(file.Name, stdout, LogDebug, nil, nil)
+		readers.Done()
+	}()
+	go func() {
+		logOutput(file.Name, stderr, LogInfo, &lastLine, &lastLineLock)
+		readers.Done()
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		readers.Wait()
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-exited:
+	case <-stop:
+		cmd.Process.Kill()
+		err = <-exited
+	}
+
+	if err != nil && lastLine != "" {
+		return &commandError{err: err, output: lastLine}
+	}
+	return err
+}
+
+// commandError is a failed command along with the last thing it printed to stderr. It
+// unwraps to the underlying error so exit codes can still be found.
+type commandError struct {
+	err    error
+	output string
+}
+
+func (self *commandError) Error() string {
+	return fmt.Sprintf("%s: %s", self.err, self.output)
+}
+
+func (self *commandError) Unwrap() error {
+	return self.err
+}
+
+func (self *CommandSeeder) Start(file *File, metadata *Metadata) error {
+	self.supervisor.start(file, self.Restart, func(stop chan bool) error {
+		return self.runCommand(file, metadata, stop)
+	})
+	return nil
+}
+
+func (self *CommandSeeder) Stop(file *File) error {
+	self.supervisor.stop(file)
+	return nil
+}
+
+func (self *CommandSeeder) Status(file *File) SeedStatus {
+	return self.supervisor.status(file)
+}
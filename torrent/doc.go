@@ -5,14 +5,18 @@ package torrent
 //
 // To use, just create a distributor, and starts its "Run" message in a goroutine:
 //
-//    distributor, err := torrent.NewDistributor(VerbNormal, "dirname", "/usr/local/bin/ctorrent",
-//           "127.0.0.1", 6390)
+//    distributor, err := torrent.NewDistributor("dirname", torrent.NewNativeSeeder(),
+//           "127.0.0.1", 6390, VerbNormal)
 //	   if err != nil {
 //	      fmt.Fprintf(os.Stderr, "Error Creating distributor: %v\n", err)
 //        os.Exit(1)
 //     }
 //     go distributor.Run()
 //
+// The Seeder decides how files get seeded. NewNativeSeeder uses the built-in seeder,
+// NewCtorrentSeeder runs ctorrent, NewCommandSeeder runs any other client and NullSeeder does
+// nothing at all, for tracker-only nodes. A nil Seeder means the built-in one.
+//
 // To stop the distributor cleanly, call its "Close" method:
 //
 //     distributor.Close()
@@ -3,24 +3,40 @@ package torrent
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
-	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 )
 
 type Distributor struct {
-	dir       string
-	ctorrent  string
+	roots     map[string]string // Directories we serve, by name.
+	rootsLock sync.Mutex        // Roots can be added and removed while we're running.
+
+	// Watcher options for particular roots; the others use woptions. Guarded by rootsLock.
+	rootOptions map[string]WatcherOptions
+
+	seeder    Seeder
+	policy    SeedPolicy
+	mdoptions MetadataOptions
+	woptions  WatcherOptions
+	toptions  TrackerOptions
 	address   string
 	port      int
 	quitChan  chan bool
-	watchers  map[string]*Watcher
 	tracker   *Tracker
 	verbosity Verbosity
+
+	// Shared by all of our watchers, including ones added later.
+	registry *Registry
+	ready    chan *File
 }
 
 func NewDistributor(
 	dir string,
-	ctorrentPath string,
+	seeder Seeder,
 	address string,
 	port int,
 	verbosity Verbosity) (*Distributor, error) {
@@ -34,25 +50,253 @@ func NewDistributor(
 		LogError("serve path is not a directory")
 		return nil, errors.New("serve path is not a directory")
 	}
-	if _, err = os.Stat(ctorrentPath); err != nil {
-		LogError("ctorrent binary not found at: %s", ctorrentPath)
-		return nil, errors.New(fmt.Sprintf("ctorrent binary not found at: %s", ctorrentPath))
+	if seeder == nil {
+		seeder = NewNativeSeeder()
 	}
 	if port < 1 || port > 65535 {
 		LogError("port must be in range 1..65535")
 		return nil, errors.New("port must be in range 1..65535")
 	}
+	dir = filepath.Clean(dir)
 	return &Distributor{
-		dir:       dir,
-		ctorrent:  ctorrentPath,
-		address:   address,
-		port:      port,
-		quitChan:  make(chan bool),
-		verbosity: verbosity,
+		roots:       map[string]string{filepath.Base(dir): dir},
+		rootOptions: make(map[string]WatcherOptions),
+		seeder:      seeder,
+		policy:      DefaultSeedPolicy,
+		mdoptions:   DefaultMetadataOptions,
+		woptions:    DefaultWatcherOptions,
+		toptions:    DefaultTrackerOptions,
+		address:     address,
+		port:        port,
+		quitChan:    make(chan bool),
+		verbosity:   verbosity,
 	}, nil
 
 }
 
+// checkRoot checks that dir can be served as name alongside roots, and returns it cleaned up.
+func checkRoot(roots map[string]string, name, dir string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/=,") {
+		LogError("invalid root name %q", name)
+		return "", errors.New(fmt.Sprintf("invalid root name %q", name))
+	}
+	if _, ok := roots[name]; ok {
+		LogError("root %s already exists", name)
+		return "", errors.New(fmt.Sprintf("root %s already exists", name))
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		LogError("root %s does not exist: %s", name, err)
+		return "", err
+	}
+	if !info.IsDir() {
+		LogError("root %s is not a directory", name)
+		return "", errors.New(fmt.Sprintf("root %s is not a directory", name))
+	}
+	dir = filepath.Clean(dir)
+	for otherName, otherDir := range roots {
+		if dir == otherDir || strings.HasPrefix(dir, otherDir+"/") ||
+			strings.HasPrefix(otherDir, dir+"/") {
+			LogError("roots %s and %s overlap", name, otherName)
+			return "", errors.New(fmt.Sprintf("roots %s and %s overlap", name, otherName))
+		}
+	}
+	return dir, nil
+}
+
+// SetRoots changes the directories we serve, replacing the one given to NewDistributor. Each
+// is served under its name, e.g. with roots {"pkgs": "/srv/pkgs"}, /srv/pkgs/foo.deb is
+// served as pkgs/foo.deb. Names can't contain slashes, and directories can't be inside each
+// other. It must be called before Start; see AddRoot and RemoveRoot for after.
+func (dist *Distributor) SetRoots(roots map[string]string) error {
+	if len(roots) == 0 {
+		LogError("no directories to serve")
+		return errors.New("no directories to serve")
+	}
+	cleaned := make(map[string]string, len(roots))
+	for name, dir := range roots {
+		dir, err := checkRoot(cleaned, name, dir)
+		if err != nil {
+			return err
+		}
+		cleaned[name] = dir
+	}
+	dist.rootsLock.Lock()
+	dist.roots = cleaned
+	dist.rootsLock.Unlock()
+	return nil
+}
+
+// Roots returns the directories we serve, by name.
+func (dist *Distributor) Roots() map[string]string {
+	dist.rootsLock.Lock()
+	defer dist.rootsLock.Unlock()
+
+	roots := make(map[string]string, len(dist.roots))
+	for name, dir := range dist.roots {
+		roots[name] = dir
+	}
+	return roots
+}
+
+// AddRoot starts serving another directory, as name (see SetRoots). If we're running, it's
+// watched and hashed straight away.
+func (dist *Distributor) AddRoot(name, dir string) error {
+	dist.rootsLock.Lock()
+	defer dist.rootsLock.Unlock()
+
+	dir, err := checkRoot(dist.roots, name, dir)
+	if err != nil {
+		return err
+	}
+	if dist.tracker != nil {
+		watcher := StartWatcher(dir, dist.mdoptions, dist.watcherOptions(name),
+			dist.ready, dist.registry)
+		if err := dist.tracker.AddWatcher(name, watcher); err != nil {
+			watcher.Close()
+			return err
+		}
+		LogInfo("distributing %s as %s", dir, name)
+	}
+	dist.roots[name] = dir
+	return nil
+}
+
+// noRootError is returned when asked about a root we don't have.
+type noRootError string
+
+func (self noRootError) Error() string {
+	return fmt.Sprintf("no root called %s", string(self))
+}
+
+// RemoveRoot stops serving the directory called name. If we're running, it stops being
+// watched, its seeds are stopped and the metadata for its files is dropped. Caches of the
+// metadata are kept, in case it's added again.
+func (dist *Distributor) RemoveRoot(name string) error {
+	dist.rootsLock.Lock()
+	defer dist.rootsLock.Unlock()
+
+	dir, ok := dist.roots[name]
+	if !ok {
+		LogError("no root called %s", name)
+		return noRootError(name)
+	}
+	if dist.tracker != nil {
+		if watcher := dist.tracker.RemoveWatcher(name); watcher != nil {
+			watcher.Close()
+			files := watcher.purge()
+			dist.tracker.stopSeeds(files)
+			LogInfo("no longer distributing %s as %s (%d files)", dir, name, len(files))
+		}
+	}
+	delete(dist.roots, name)
+	return nil
+}
+
+// SetSeedPolicy changes how files get seeded. It must be called before Start.
+func (dist *Distributor) SetSeedPolicy(policy SeedPolicy) error {
+	if err := policy.Validate(); err != nil {
+		LogError("invalid seed policy: %s", err)
+		return err
+	}
+	dist.policy = policy
+	return nil
+}
+
+// SetMetadataOptions changes how torrent metadata is generated. It must be called before Start.
+func (dist *Distributor) SetMetadataOptions(options MetadataOptions) error {
+	if options.Version < TorrentV1 || options.Version > TorrentHybrid {
+		LogError("invalid torrent version: %d", options.Version)
+		return errors.New("invalid torrent version")
+	}
+	if err := options.Validate(); err != nil {
+		LogError("invalid metadata options: %s", err)
+		return err
+	}
+	if options.CacheDir != "" {
+		if err := os.MkdirAll(options.CacheDir, 0755); err != nil {
+			LogError("invalid cache directory: %s", err)
+			return err
+		}
+	}
+	if options.HashWorkers < 0 || options.Concurrency < 0 {
+		LogError("invalid hashing concurrency: %d workers, %d files", options.HashWorkers,
+			options.Concurrency)
+		return errors.New("invalid hashing concurrency")
+	}
+	dist.mdoptions = options
+	return nil
+}
+
+// SetWatcherOptions changes which files are published, and when. It must be called before Start.
+func (dist *Distributor) SetWatcherOptions(options WatcherOptions) error {
+	if err := options.Validate(); err != nil {
+		LogError("invalid watcher options: %s", err)
+		return err
+	}
+	dist.woptions = options
+	return nil
+}
+
+// SetRootOptions changes which files are published, and when, for the root called name
+// (which needn't have been added yet), instead of the options given to SetWatcherOptions. If
+// the root is being served, the change takes effect the next time it's added.
+func (dist *Distributor) SetRootOptions(name string, options WatcherOptions) error {
+	if err := options.Validate(); err != nil {
+		LogError("invalid watcher options for %s: %s", name, err)
+		return err
+	}
+	dist.rootsLock.Lock()
+	defer dist.rootsLock.Unlock()
+
+	dist.rootOptions[name] = options
+	return nil
+}
+
+// watcherOptions returns the watcher options for the root called name. Must be called with
+// rootsLock held.
+func (dist *Distributor) watcherOptions(name string) WatcherOptions {
+	if options, ok := dist.rootOptions[name]; ok {
+		return options
+	}
+	return dist.woptions
+}
+
+// SetTrackerOptions changes how the tracker runs. It must be called before Start.
+func (dist *Distributor) SetTrackerOptions(options TrackerOptions) error {
+	if options.UDPPort < -1 || options.UDPPort > 65535 {
+		LogError("invalid UDP port: %d", options.UDPPort)
+		return errors.New("invalid UDP port")
+	}
+	if len(options.ClusterMembers) > 0 && options.ClusterSecret == "" {
+		LogError("cluster members given without a cluster secret")
+		return errors.New("cluster needs a secret")
+	}
+	for _, member := range options.ClusterMembers {
+		if _, _, err := net.SplitHostPort(member); err != nil {
+			LogError("invalid cluster member %s: %s", member, err)
+			return errors.New(fmt.Sprintf("invalid cluster member %s", member))
+		}
+	}
+	if options.SaveInterval < 0 || options.ClusterSyncInterval < 0 {
+		LogError("invalid save interval %s or cluster sync interval %s", options.SaveInterval,
+			options.ClusterSyncInterval)
+		return errors.New("invalid save or cluster sync interval")
+	}
+	if options.PeerTTL < 0 || options.ReapInterval < 0 {
+		LogError("invalid peer TTL %s or reap interval %s", options.PeerTTL,
+			options.ReapInterval)
+		return errors.New("invalid peer TTL or reap interval")
+	}
+	if options.DefaultNumWant < 0 || options.MaxNumWant < 0 {
+		LogError("invalid numwant: default %d, max %d", options.DefaultNumWant,
+			options.MaxNumWant)
+		return errors.New("invalid numwant")
+	}
+	dist.toptions = options
+	return nil
+}
+
 func (dist *Distributor) Run() {
 	dist.Start()
 	dist.Wait()
@@ -63,11 +307,36 @@ func (dist *Distributor) Start() {
 	// tracker coordinates peers and torrent files. To each tracker we can attach a set of watchers,
 	// which handle monitoring of files.
 	SetLoggingVerbosity(dist.verbosity)
-	dist.watchers = map[string]*Watcher{
-		path.Base(dist.dir): StartWatcher(dist.dir),
+	if seeder, ok := dist.seeder.(PolicySeeder); ok {
+		seeder.SetSeedPolicy(dist.policy)
+	}
+
+	// With eager seeding the watchers tell the tracker about every file that's ready.
+	if dist.policy.Eager {
+		dist.ready = make(chan *File, 1000)
+	}
+	// The watchers record the info_hash of every torrent they make, and the tracker only
+	// accepts announces for those.
+	dist.registry = NewRegistry()
+
+	dist.rootsLock.Lock()
+	defer dist.rootsLock.Unlock()
+	watchers := make(map[string]*Watcher)
+	for name, dir := range dist.roots {
+		watchers[name] = StartWatcher(dir, dist.mdoptions, dist.watcherOptions(name),
+			dist.ready, dist.registry)
+	}
+	dist.tracker = StartTracker(dist.address, dist.port, dist.seeder, dist.policy, watchers,
+		dist.registry, dist.toptions)
+	if dist.ready != nil {
+		go dist.tracker.SeedEagerly(dist.ready)
+	}
+	if dist.toptions.AdminToken != "" {
+		dist.tracker.Handle("/admin/roots", http.HandlerFunc(dist.handleAdminRoots))
+	}
+	for name, dir := range dist.roots {
+		LogInfo("distributing %s as %s on %s:%d", dir, name, dist.address, dist.port)
 	}
-	dist.tracker = StartTracker(dist.address, dist.port, dist.ctorrent, dist.watchers)
-	LogInfo("distributing %s on %s:%d", dist.dir, dist.address, dist.port)
 }
 
 func (dist *Distributor) Wait() {
@@ -75,8 +344,17 @@ func (dist *Distributor) Wait() {
 }
 
 func (dist *Distributor) Close() {
-	for _, w := range dist.watchers {
-		w.Close()
+	dist.rootsLock.Lock()
+	tracker := dist.tracker
+	dist.rootsLock.Unlock()
+	if tracker != nil {
+		for name := range tracker.getWatchers() {
+			if w := tracker.RemoveWatcher(name); w != nil {
+				w.Close()
+				tracker.stopSeeds(append(w.GetFiles(), w.GetDirs()...))
+			}
+		}
+		tracker.Close()
 	}
 	dist.quitChan <- true
 }
@@ -0,0 +1,184 @@
+package torrent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, subdir := range []string{"images", "pkgs", "pkgs/nested"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(dir, subdir), 0755))
+	}
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644))
+
+	dist, err := NewDistributor(filepath.Join(dir, "images"), NullSeeder{}, "127.0.0.1", 1,
+		VerbNormal)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"images": filepath.Join(dir, "images")}, dist.roots)
+
+	assert.Nil(t, dist.SetRoots(map[string]string{
+		"images": filepath.Join(dir, "images") + "/",
+		"pkgs":   filepath.Join(dir, "pkgs"),
+	}))
+	assert.Equal(t, filepath.Join(dir, "images"), dist.roots["images"])
+
+	for _, roots := range []map[string]string{
+		{},
+		{"": filepath.Join(dir, "images")},
+		{"a/b": filepath.Join(dir, "images")},
+		{"missing": filepath.Join(dir, "missing")},
+		{"file": filepath.Join(dir, "file")},
+		{"pkgs": filepath.Join(dir, "pkgs"), "nested": filepath.Join(dir, "pkgs/nested")},
+		{"one": filepath.Join(dir, "pkgs"), "two": filepath.Join(dir, "pkgs")},
+	} {
+		assert.NotNil(t, dist.SetRoots(roots), "%v", roots)
+	}
+	assert.Len(t, dist.roots, 2, "unchanged after errors")
+}
+
+func TestSetRootOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dist, err := NewDistributor(dir, NullSeeder{}, "127.0.0.1", 1, VerbNormal)
+	assert.Nil(t, err)
+
+	assert.Nil(t, dist.SetWatcherOptions(WatcherOptions{MaxSize: 10}))
+	assert.Nil(t, dist.SetRootOptions("pkgs", WatcherOptions{MinSize: 5}))
+	assert.NotNil(t, dist.SetRootOptions("pkgs", WatcherOptions{ExcludeGlobs: []string{"[x"}}))
+	assert.Equal(t, WatcherOptions{MinSize: 5}, dist.watcherOptions("pkgs"))
+	assert.Equal(t, WatcherOptions{MaxSize: 10}, dist.watcherOptions("images"))
+}
+
+// waitFor polls until check returns true, failing the test if it takes too long.
+func waitFor(t *testing.T, what string, check func() bool) {
+	for start := time.Now(); !check(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestAddAndRemoveRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, path := range []string{"images/one", "pkgs/two"} {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644))
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	seeder := newFakeSeeder()
+	dist, err := NewDistributor(filepath.Join(dir, "images"), seeder, "127.0.0.1", port,
+		VerbNormal)
+	assert.Nil(t, err)
+	policy := DefaultSeedPolicy
+	policy.Eager = true
+	assert.Nil(t, dist.SetSeedPolicy(policy))
+	toptions := DefaultTrackerOptions
+	toptions.UDPPort = -1
+	toptions.AdminToken = "sekrit"
+	assert.Nil(t, dist.SetTrackerOptions(toptions))
+	dist.Start()
+	go dist.Wait() // Close signals it.
+	defer dist.Close()
+
+	admin := func(method, query, token string) (int, string) {
+		r, err := http.NewRequest(method,
+			fmt.Sprintf("http://127.0.0.1:%d/admin/roots?%s", port, query), nil)
+		assert.Nil(t, err)
+		r.Header.Set("Authorization", "Bearer "+token)
+		for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			response, err := http.DefaultClient.Do(r)
+			if err != nil && time.Since(start) < 10*time.Second {
+				continue // The server is still starting.
+			}
+			assert.Nil(t, err)
+			defer response.Body.Close()
+			body, _ := ioutil.ReadAll(response.Body)
+			return response.StatusCode, string(body)
+		}
+	}
+	seeded := func(name string) func() bool {
+		return func() bool {
+			file := dist.tracker.findFile(name)
+			return file != nil && seeder.Status(file).Running()
+		}
+	}
+
+	code, _ := admin("POST", "name=pkgs&dir="+filepath.Join(dir, "pkgs"), "wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, body := admin("POST", "name=pkgs&dir="+filepath.Join(dir, "pkgs"), "sekrit")
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Contains(t, body, `"pkgs":`)
+	code, _ = admin("POST", "name=more&dir="+filepath.Join(dir, "pkgs"), "sekrit")
+	assert.Equal(t, http.StatusBadRequest, code, "overlaps")
+
+	waitFor(t, "images/one to be seeded", seeded("images/one"))
+	waitFor(t, "pkgs/two to be seeded", seeded("pkgs/two"))
+	file := dist.tracker.findFile("pkgs/two")
+	file.Lock.Lock()
+	hashes, err := file.MetadataInfo.SwarmHashes()
+	file.Lock.Unlock()
+	assert.Nil(t, err)
+	assert.Equal(t, file, dist.registry.Lookup(string(hashes[0])))
+
+	code, body = admin("DELETE", "name=pkgs", "sekrit")
+	assert.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, map[string]string{"images": filepath.Join(dir, "images")}, dist.Roots())
+	assert.Nil(t, dist.tracker.findFile("pkgs/two"))
+	assert.False(t, seeder.Status(file).Running(), "seeds are stopped")
+	assert.Nil(t, dist.registry.Lookup(string(hashes[0])), "metadata is purged")
+	assert.NotNil(t, dist.tracker.findFile("images/one"))
+
+	code, _ = admin("DELETE", "name=pkgs", "sekrit")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestCloseStopsSeeds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	seeder := newFakeSeeder()
+	dist, err := NewDistributor(dir, seeder, "127.0.0.1", port, VerbNormal)
+	assert.Nil(t, err)
+	policy := DefaultSeedPolicy
+	policy.Eager = true
+	assert.Nil(t, dist.SetSeedPolicy(policy))
+	toptions := DefaultTrackerOptions
+	toptions.UDPPort = -1
+	assert.Nil(t, dist.SetTrackerOptions(toptions))
+	dist.Start()
+
+	var file *File
+	waitFor(t, "file to be seeded", func() bool {
+		file = dist.tracker.findFile(filepath.Base(dir) + "/file")
+		return file != nil && seeder.Status(file).Running()
+	})
+	go dist.Wait() // Close signals it.
+	dist.Close()
+	assert.False(t, seeder.Status(file).Running(), "seeds are stopped")
+}
@@ -0,0 +1,130 @@
+/*
+ * filter.go
+ *
+ * Decides which of the files in a watched directory we serve: include and exclude patterns,
+ * size limits and what to do about symlinks, as set in the watcher's options.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// validateFilters checks the patterns and size limits in a watcher's options.
+func (self WatcherOptions) validateFilters() error {
+	globs := append(append([]string{}, self.IncludeGlobs...), self.ExcludeGlobs...)
+	for _, glob := range globs {
+		if _, err := filepath.Match(glob, ""); err != nil || glob == "" {
+			return errors.New(fmt.Sprintf("invalid glob %q", glob))
+		}
+	}
+	regexps := append([]*regexp.Regexp{}, self.IncludeRegexps...)
+	regexps = append(regexps, self.ExcludeRegexps...)
+	for _, re := range regexps {
+		if re == nil {
+			return errors.New("missing regexp")
+		}
+	}
+	if self.MinSize < 0 || self.MaxSize < 0 ||
+		(self.MaxSize > 0 && self.MinSize > self.MaxSize) {
+		return errors.New(fmt.Sprintf("invalid size limits %d to %d", self.MinSize,
+			self.MaxSize))
+	}
+	return nil
+}
+
+// matchGlob says whether a glob matches a path relative to the watched directory. Globs with a
+// slash are matched against the whole path, others against its last component.
+func matchGlob(glob, localfn string) bool {
+	if !strings.Contains(glob, "/") {
+		localfn = filepath.Base(localfn)
+	}
+	matched, _ := filepath.Match(glob, localfn)
+	return matched
+}
+
+// excluded says whether a file or directory, relative to the watched directory, matches one of
+// the excludes.
+func (self WatcherOptions) excluded(localfn string) bool {
+	for _, glob := range self.ExcludeGlobs {
+		if matchGlob(glob, localfn) {
+			return true
+		}
+	}
+	for _, re := range self.ExcludeRegexps {
+		if re.MatchString(localfn) {
+			return true
+		}
+	}
+	return false
+}
+
+// included says whether a file, relative to the watched directory, matches one of the
+// includes. Everything does if there aren't any.
+func (self WatcherOptions) included(localfn string) bool {
+	if len(self.IncludeGlobs) == 0 && len(self.IncludeRegexps) == 0 {
+		return true
+	}
+	for _, glob := range self.IncludeGlobs {
+		if matchGlob(glob, localfn) {
+			return true
+		}
+	}
+	for _, re := range self.IncludeRegexps {
+		if re.MatchString(localfn) {
+			return true
+		}
+	}
+	return false
+}
+
+// symlinkLoops says whether a symlink points to a directory it's in, so following it would
+// never end.
+func symlinkLoops(fqfn string) bool {
+	target, err := filepath.EvalSymlinks(fqfn)
+	if err != nil {
+		return true
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(fqfn))
+	if err != nil {
+		return true
+	}
+	return parent == target || strings.HasPrefix(parent, target+"/")
+}
+
+// wanted says whether we serve a file, relative to the watched directory, or for a directory,
+// whether we look inside it. info is what it (or what it links to) looks like now. Includes and
+// size limits only apply to files, so they don't stop us finding files in subdirectories.
+func (self *Watcher) wanted(localfn string, info os.FileInfo) bool {
+	fqfn := filepath.Join(self.Directory, localfn)
+	if link, err := os.Lstat(fqfn); err == nil && link.Mode()&os.ModeSymlink != 0 {
+		if self.Options.SkipSymlinks {
+			return false
+		}
+		if info.IsDir() && symlinkLoops(fqfn) {
+			LogError("Not following %s: it links to a directory it's in.", fqfn)
+			return false
+		}
+	}
+	if self.Options.excluded(localfn) {
+		return false
+	}
+	if info.IsDir() {
+		return true
+	}
+	if !self.Options.included(localfn) {
+		return false
+	}
+	return info.Size() >= self.Options.MinSize &&
+		(self.Options.MaxSize == 0 || info.Size() <= self.Options.MaxSize)
+}
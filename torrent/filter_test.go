@@ -0,0 +1,154 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterValidate(t *testing.T) {
+	assert.Nil(t, WatcherOptions{IncludeGlobs: []string{"*.iso"}, MinSize: 1,
+		MaxSize: 1}.Validate())
+	assert.NotNil(t, WatcherOptions{ExcludeGlobs: []string{"[x"}}.Validate())
+	assert.NotNil(t, WatcherOptions{IncludeGlobs: []string{""}}.Validate())
+	assert.NotNil(t, WatcherOptions{ExcludeRegexps: []*regexp.Regexp{nil}}.Validate())
+	assert.NotNil(t, WatcherOptions{MinSize: -1}.Validate())
+	assert.NotNil(t, WatcherOptions{MinSize: 2, MaxSize: 1}.Validate())
+}
+
+func TestFilterPatterns(t *testing.T) {
+	options := WatcherOptions{
+		IncludeGlobs:   []string{"*.iso", "pkgs/*.deb"},
+		IncludeRegexps: []*regexp.Regexp{regexp.MustCompile(`^images/.*\.img$`)},
+		ExcludeGlobs:   []string{".*", "*.swp", "tmp"},
+		ExcludeRegexps: []*regexp.Regexp{regexp.MustCompile(`~$`)},
+	}
+	for localfn, included := range map[string]bool{
+		"a.iso":            true,
+		"deep/down/b.iso":  true,
+		"pkgs/c.deb":       true,
+		"other/pkgs/c.deb": false,
+		"images/d/e.img":   true,
+		"f.img":            false,
+		"notes.txt":        false,
+		".hidden.iso":      false, // Excluded, despite matching an include.
+		"g.iso.swp":        false,
+		"tmp":              false,
+		"pkgs/h.deb~":      false,
+	} {
+		assert.Equal(t, included, options.included(localfn) && !options.excluded(localfn),
+			localfn)
+	}
+
+	// Everything's included if there are no includes.
+	assert.True(t, WatcherOptions{}.included("anything"))
+}
+
+func TestFilterWanted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "small"), []byte("1"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "large"), []byte("12345"), 0644))
+	assert.Nil(t, os.Symlink("large", filepath.Join(dir, "link")))
+	assert.Nil(t, os.Symlink("sub", filepath.Join(dir, "linkdir")))
+	assert.Nil(t, os.Symlink("..", filepath.Join(dir, "sub", "loop")))
+
+	watcher := &Watcher{Directory: dir, Options: WatcherOptions{MinSize: 2, MaxSize: 5}}
+	wanted := func(localfn string) bool {
+		info, err := os.Stat(filepath.Join(dir, localfn))
+		assert.Nil(t, err)
+		return watcher.wanted(localfn, info)
+	}
+	assert.False(t, wanted("small"))
+	assert.True(t, wanted("large"))
+	assert.True(t, wanted("link"))
+	assert.True(t, wanted("linkdir"))
+	assert.False(t, wanted("sub/loop"))
+	assert.True(t, wanted("sub")) // Size limits don't apply to directories.
+
+	watcher.Options.MaxSize = 4
+	assert.False(t, wanted("large"))
+
+	watcher.Options = WatcherOptions{SkipSymlinks: true}
+	assert.True(t, wanted("large"))
+	assert.False(t, wanted("link"))
+	assert.False(t, wanted("linkdir"))
+}
+
+func TestWatcherFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	target, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(target)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(target, "linked"), []byte("linked"), 0644))
+	assert.Nil(t, os.Symlink(target, filepath.Join(dir, "link")))
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, ".git"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".git", "config"), []byte("x"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "file.swp"), []byte("swap"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "tiny"), []byte("x"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("hidden"), 0644))
+
+	// Hidden files aren't served even without an exclude for them.
+	options := WatcherOptions{ExcludeGlobs: []string{"*.swp"}, MinSize: 2}
+	ready := make(chan *File, 100)
+	watcher := StartWatcher(dir, DefaultMetadataOptions, options, ready, nil)
+	defer watcher.Close()
+
+	// Files in symlinked directories are served, but not hidden ones, excluded ones or ones
+	// that are too small.
+	assert.Equal(t, filepath.Join(dir, "link", "linked"), (<-ready).FQFN)
+	assert.Equal(t, []string{"link/linked"}, watchedFiles(watcher))
+
+	// Until they're big enough. Hidden files that change are still ignored.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".hidden"), []byte("changed"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "tiny"), []byte("xx"), 0644))
+	assert.Equal(t, "tiny", (<-ready).Name)
+	assert.Equal(t, []string{"link/linked", "tiny"}, watchedFiles(watcher))
+}
+
+func TestWatcherMutualSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"a", "b"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(dir, sub), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, sub, "f"+sub), []byte(sub), 0644))
+	}
+	assert.Nil(t, os.Symlink("../b", filepath.Join(dir, "a", "l")))
+	assert.Nil(t, os.Symlink("../a", filepath.Join(dir, "b", "l")))
+
+	// Neither link leads to a directory it's in, but following one and then the other does, so
+	// the second one we come to isn't followed.
+	ready := make(chan *File, 100)
+	watcher := StartWatcher(dir, DefaultMetadataOptions, DefaultWatcherOptions, ready, nil)
+	defer watcher.Close()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ready:
+		case <-time.After(10 * time.Second):
+			t.Fatal("files weren't published")
+		}
+	}
+	assert.Equal(t, []string{"a/fa", "a/l/fb", "b/fb"}, watchedFiles(watcher))
+}
+
+func watchedFiles(watcher *Watcher) []string {
+	watcher.FilesLock.Lock()
+	defer watcher.FilesLock.Unlock()
+	var files []string
+	for localfn := range watcher.Files {
+		files = append(files, localfn)
+	}
+	sort.Strings(files)
+	return files
+}
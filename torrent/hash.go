@@ -0,0 +1,103 @@
+/*
+ * hash.go
+ *
+ * Parallel piece hashing. Pieces are independent, so big files are hashed by a pool of
+ * workers that each read their own pieces with ReadAt.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// hashPieces splits data into pieces and hashes each of them with hashPiece, using up to
+// workers goroutines (0 means one per CPU). progress, if not nil, is called with the size of
+// every piece as it's done; it must be safe to call from several goroutines.
+func hashPieces(data io.ReaderAt, dataSize, pieceLength int64, workers int,
+	progress func(int64), hashPiece func([]byte) []byte) ([][]byte, error) {
+	count := int((dataSize + pieceLength - 1) / pieceLength)
+	hashes := make([][]byte, count)
+	if count == 0 {
+		return hashes, nil
+	}
+
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	if workers > count {
+		workers = count
+	}
+
+	var firstErr error
+	var errLock sync.Mutex
+	failed := func() bool {
+		errLock.Lock()
+		defer errLock.Unlock()
+		return firstErr != nil
+	}
+
+	indexes := make(chan int, workers)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, pieceLength)
+			for i := range indexes {
+				if failed() {
+					continue
+				}
+
+				offset := int64(i) * pieceLength
+				n := dataSize - offset
+				if n > pieceLength {
+					n = pieceLength
+				}
+				read, err := data.ReadAt(buf[:n], offset)
+				if err != nil && !(err == io.EOF && int64(read) == n) {
+					errLock.Lock()
+					if firstErr == nil {
+						firstErr = errors.New(fmt.Sprintf("Failed to read: %s", err))
+					}
+					errLock.Unlock()
+					continue
+				}
+
+				hashes[i] = hashPiece(buf[:n])
+				if progress != nil {
+					progress(n)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return hashes, nil
+}
+
+// makeHashesAt calculates the SHA1 hash of every piece of data, in parallel.
+func makeHashesAt(data io.ReaderAt, dataSize, pieceLength int64, workers int,
+	progress func(int64)) ([][]byte, error) {
+	return hashPieces(data, dataSize, pieceLength, workers, progress, func(piece []byte) []byte {
+		hash := sha1.Sum(piece)
+		return hash[:]
+	})
+}
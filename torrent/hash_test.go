@@ -0,0 +1,58 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeHashesAtWorkers(t *testing.T) {
+	data := strings.Repeat("0123456789", int(3*testPieceLength/10)+7)
+	var expected [][]byte
+	for offset := 0; offset < len(data); offset += int(testPieceLength) {
+		end := offset + int(testPieceLength)
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum([]byte(data[offset:end]))
+		expected = append(expected, hash[:])
+	}
+	assert.Len(t, expected, 4)
+
+	for _, workers := range []int{0, 1, 3, 16} {
+		var progress int64
+		hashes, err := makeHashesAt(strings.NewReader(data), int64(len(data)), testPieceLength,
+			workers, func(n int64) { atomic.AddInt64(&progress, n) })
+		assert.Nil(t, err)
+		assert.Equal(t, expected, hashes, "workers: %d", workers)
+		assert.Equal(t, int64(len(data)), progress, "every byte is reported once")
+	}
+}
+
+func TestMakeHashesAtShortRead(t *testing.T) {
+	// The file shrank since we looked at its size.
+	data := bytes.Repeat([]byte("x"), int(testPieceLength))
+	_, err := makeHashesAt(bytes.NewReader(data), 2*testPieceLength, testPieceLength, 2, nil)
+	assert.NotNil(t, err)
+
+	hashes, err := makeHashesAt(bytes.NewReader(nil), 0, testPieceLength, 2, nil)
+	assert.Nil(t, err)
+	assert.Empty(t, hashes)
+}
+
+// TestMakeV2HashesParallel checks the worker pool gives the same answer as a single worker.
+func TestMakeV2HashesParallel(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefg"), int(5*testPieceLength/7))
+	var reader io.ReaderAt = bytes.NewReader(data)
+	layer, root, err := makeV2Hashes(reader, int64(len(data)), testPieceLength, 1, nil)
+	assert.Nil(t, err)
+	layer2, root2, err := makeV2Hashes(reader, int64(len(data)), testPieceLength, 8, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, layer, layer2)
+	assert.Equal(t, root, root2)
+}
@@ -0,0 +1,18 @@
+/*
+ * inode_windows.go
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"os"
+)
+
+// fileInode returns 0; Windows has file IDs, but os.FileInfo doesn't expose them.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
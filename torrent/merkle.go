@@ -0,0 +1,120 @@
+/*
+ * merkle.go
+ *
+ * SHA-256 merkle trees for BitTorrent v2 (BEP 52) metadata. Each file is split into 16KB
+ * blocks, which are the leaves of a binary tree. The tree is padded out to a power of two
+ * leaves with zero hashes. The layer of the tree where each node covers one piece is the
+ * "piece layer", and the top is the file's "pieces root".
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Size of the leaves of a v2 merkle tree; fixed by the spec.
+const BLOCK_LENGTH = int64(16 * 1024)
+
+// Hash used for leaves past the end of a file.
+var zeroHash = make([]byte, sha256.Size)
+
+// nextPowerOfTwo returns the smallest power of two that is >= n (and at least 1).
+func nextPowerOfTwo(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// merkleRoot computes the root of a tree whose bottom layer is hashes, padded with pad up to
+// width entries. width must be a power of two no smaller than len(hashes).
+func merkleRoot(hashes [][]byte, width int, pad []byte) []byte {
+	layer := make([][]byte, width)
+	for i := range layer {
+		if i < len(hashes) {
+			layer[i] = hashes[i]
+		} else {
+			layer[i] = pad
+		}
+	}
+
+	for len(layer) > 1 {
+		next := make([][]byte, len(layer)/2)
+		for i := range next {
+			hash := sha256.New()
+			hash.Write(layer[2*i])
+			hash.Write(layer[2*i+1])
+			next[i] = hash.Sum(nil)
+		}
+		layer = next
+	}
+	return layer[0]
+}
+
+// padPieceHash is the piece layer hash of a piece made entirely of padding, used to fill out
+// the piece layer to a power of two.
+func padPieceHash(pieceLength int64) []byte {
+	return merkleRoot(nil, int(pieceLength/BLOCK_LENGTH), zeroHash)
+}
+
+// rootFromPieceLayer computes a file's pieces root from its piece layer.
+func rootFromPieceLayer(layer [][]byte, pieceLength int64) []byte {
+	return merkleRoot(layer, nextPowerOfTwo(len(layer)), padPieceHash(pieceLength))
+}
+
+// blockHashes returns the SHA-256 hash of each 16KB block of piece.
+func blockHashes(piece []byte) [][]byte {
+	leaves := make([][]byte, 0, (int64(len(piece))+BLOCK_LENGTH-1)/BLOCK_LENGTH)
+	for off := int64(0); off < int64(len(piece)); off += BLOCK_LENGTH {
+		end := off + BLOCK_LENGTH
+		if end > int64(len(piece)) {
+			end = int64(len(piece))
+		}
+		sum := sha256.Sum256(piece[off:end])
+		leaves = append(leaves, sum[:])
+	}
+	return leaves
+}
+
+// makeV2Hashes reads a file and returns its piece layer and pieces root. Files no bigger than
+// one piece have no piece layer, just a root. Pieces are hashed in parallel, see hashPieces.
+func makeV2Hashes(data io.ReaderAt, dataSize int64, pieceLength int64, workers int,
+	progress func(int64)) ([][]byte, []byte, error) {
+	if pieceLength < BLOCK_LENGTH || pieceLength%BLOCK_LENGTH != 0 {
+		return nil, nil, errors.New(fmt.Sprintf("invalid v2 piece length %d", pieceLength))
+	}
+	blocksPerPiece := int(pieceLength / BLOCK_LENGTH)
+
+	if dataSize <= pieceLength {
+		piece, err := hashPieces(data, dataSize, pieceLength, 1, progress,
+			func(piece []byte) []byte {
+				leaves := blockHashes(piece)
+				return merkleRoot(leaves, nextPowerOfTwo(len(leaves)), zeroHash)
+			})
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(piece) == 0 {
+			return nil, merkleRoot(nil, 1, zeroHash), nil
+		}
+		return nil, piece[0], nil
+	}
+
+	layer, err := hashPieces(data, dataSize, pieceLength, workers, progress,
+		func(piece []byte) []byte {
+			return merkleRoot(blockHashes(piece), blocksPerPiece, zeroHash)
+		})
+	if err != nil {
+		return nil, nil, err
+	}
+	return layer, rootFromPieceLayer(layer, pieceLength), nil
+}
@@ -0,0 +1,113 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sha256Of(data ...[]byte) []byte {
+	hash := sha256.New()
+	for _, d := range data {
+		hash.Write(d)
+	}
+	return hash.Sum(nil)
+}
+
+func TestMakeV2HashesSingleBlock(t *testing.T) {
+	layer, root, err := makeV2Hashes(strings.NewReader("testing"), 7, testPieceLength, 0, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, layer, "files within one piece have no piece layer")
+	assert.Equal(t, sha256Of([]byte("testing")), root)
+}
+
+func TestMakeV2HashesPadsToPowerOfTwo(t *testing.T) {
+	// Three blocks are padded out to four leaves with zero hashes.
+	data := strings.Repeat("x", int(2*BLOCK_LENGTH)+10)
+	_, root, err := makeV2Hashes(strings.NewReader(data), int64(len(data)), testPieceLength, 0, nil)
+	assert.Nil(t, err)
+
+	full := sha256Of([]byte(data[:BLOCK_LENGTH]))
+	last := sha256Of([]byte(data[2*BLOCK_LENGTH:]))
+	expected := sha256Of(sha256Of(full, full), sha256Of(last, zeroHash))
+	assert.Equal(t, expected, root)
+}
+
+func TestMakeV2HashesPieceLayer(t *testing.T) {
+	// With 32KB pieces, 5 blocks make 3 pieces; the root computed from the piece layer has
+	// to match the root of the whole tree of blocks.
+	pieceLength := 2 * BLOCK_LENGTH
+	data := []byte(strings.Repeat("abcdefgh", int(5*BLOCK_LENGTH/8)))
+	layer, root, err := makeV2Hashes(bytes.NewReader(data), int64(len(data)), pieceLength, 0, nil)
+	assert.Nil(t, err)
+	assert.Len(t, layer, 3)
+
+	var leaves [][]byte
+	for off := int64(0); off < int64(len(data)); off += BLOCK_LENGTH {
+		leaves = append(leaves, sha256Of(data[off:off+BLOCK_LENGTH]))
+	}
+	assert.Equal(t, merkleRoot(leaves, 8, zeroHash), root)
+	assert.Equal(t, merkleRoot(leaves[4:], 2, zeroHash), layer[2])
+}
+
+func TestGenerateHybridMetadataInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("first"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b"), []byte("second"), 0644))
+
+	mdinfo, err := GenerateDirMetadataInfo(dir, []string{"a", "b"},
+		MetadataOptions{Version: TorrentHybrid, PieceLength: testPieceLength})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, mdinfo.MetaVersion)
+
+	// The first file is padded to a piece boundary, so there is one v1 piece per file.
+	assert.Len(t, mdinfo.Files, 3)
+	assert.True(t, mdinfo.Files[1].isPadding())
+	assert.Equal(t, testPieceLength-5, mdinfo.Files[1].Length)
+	assert.Equal(t, 2, mdinfo.NumPieces())
+
+	var paths []string
+	walkFileTree(mdinfo.FileTree, nil, func(path []string, entry FileTreeEntry) {
+		paths = append(paths, strings.Join(path, "/"))
+		assert.Len(t, entry.PiecesRoot, 32)
+	})
+	assert.Equal(t, []string{"a", "b"}, paths)
+
+	hashes, err := mdinfo.SwarmHashes()
+	assert.Nil(t, err)
+	assert.Len(t, hashes, 2, "hybrid torrents have a v1 and a v2 swarm")
+}
+
+func TestGenerateV2MetadataInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fqfn := filepath.Join(dir, "big")
+	data := bytes.Repeat([]byte("z"), int(testPieceLength)+1)
+	assert.Nil(t, ioutil.WriteFile(fqfn, data, 0644))
+
+	for i := 0; i < 2; i++ { // Second time through uses the cache.
+		mdinfo, err := GenerateMetadataInfo(fqfn,
+			MetadataOptions{Version: TorrentV2, PieceLength: testPieceLength})
+		assert.Nil(t, err)
+		assert.Empty(t, mdinfo.Pieces)
+		assert.Equal(t, int64(0), mdinfo.Length)
+		assert.Equal(t, 2, mdinfo.NumPieces())
+		assert.Equal(t, int64(len(data)), mdinfo.TotalLength())
+		assert.Len(t, mdinfo.PieceLayers, 1)
+
+		layer, root, err := makeV2Hashes(bytes.NewReader(data), int64(len(data)), testPieceLength, 0, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, string(bytes.Join(layer, []byte{})), mdinfo.PieceLayers[string(root)])
+	}
+}
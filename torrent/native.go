@@ -0,0 +1,516 @@
+/*
+ * native.go
+ *
+ * A built-in BitTorrent seeder. This speaks just enough of the peer wire protocol to hand out
+ * pieces of a complete file to downloading peers, so we don't need an external client.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// How long a seed runs before exiting. This matches the "-e 4" we have always given ctorrent;
+// seeds get restarted if someone requests the file again.
+const SEED_DURATION = 4 * time.Hour
+
+// Number of peers we upload to at once. Interested peers beyond this stay choked until a slot
+// frees up.
+const MAX_UNCHOKED = 16
+
+// Number of peer connections a single seed will accept.
+const MAX_SEED_CONNECTIONS = 200
+
+// NativeSeed seeds a single file, or a directory of files, to peers that find us through the tracker.
+type NativeSeed struct {
+	Uploaded int64  // Bytes sent to peers. Use atomic operations to read. Kept first for alignment.
+	Port     int    // Port we're accepting peer connections on.
+	name     string // Name of the file, for logging.
+	storage  *storage
+	info     *MetadataInfo
+	hashes   [][]byte // v1 and/or truncated v2 info_hash; peers may use either.
+	pieces   int      // Number of pieces, and the length of all the data.
+	length   int64
+	peerId   []byte
+	announce string
+	listener net.Listener
+
+	// Protects conns and unchoked.
+	lock     sync.Mutex
+	conns    map[*seedConn]bool
+	unchoked int
+
+	quitChannel chan bool
+	doneChannel chan bool
+	stopOnce    sync.Once
+}
+
+// seedConn is a single connected peer. The choked/interested flags are protected by the
+// lock in NativeSeed.
+type seedConn struct {
+	conn       net.Conn
+	writeLock  sync.Mutex
+	choked     bool
+	interested bool
+	closed     chan bool
+}
+
+// send writes a message to the peer. Safe to call from multiple goroutines.
+func (self *seedConn) send(msg *peerMessage) error {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+
+	self.conn.SetWriteDeadline(time.Now().Add(60 * time.Second))
+	return writeMessage(self.conn, msg)
+}
+
+// makePeerId generates a random peer_id in the Azureus style, so clients that care can tell
+// who we are.
+func makePeerId() []byte {
+	peerId := make([]byte, 20)
+	copy(peerId, "-DS0001-")
+	rand.Read(peerId[8:])
+	return peerId
+}
+
+// NativeSeeder is a Seeder that runs a NativeSeed for every file, entirely in-process.
+type NativeSeeder struct {
+	Duration   time.Duration // How long each seed runs before exiting.
+	Restart    RestartPolicy // What to do if a seed fails.
+	ports      *portPool
+	supervisor *supervisor
+}
+
+// NewNativeSeeder creates a seeder using the built-in peer wire implementation.
+func NewNativeSeeder() *NativeSeeder {
+	return &NativeSeeder{
+		Duration:   SEED_DURATION,
+		Restart:    DefaultRestartPolicy,
+		supervisor: newSupervisor(),
+	}
+}
+
+// SetSeedPolicy makes seeds run for the policy's duration on ports from its range. It must be
+// called before any seeds are started.
+func (self *NativeSeeder) SetSeedPolicy(policy SeedPolicy) {
+	self.Duration = policy.Duration
+	self.ports = newPortPool(policy.MinPort, policy.MaxPort)
+}
+
+// startSeed starts a seed on a port from our pool. Ports that something else is already
+// listening on are skipped.
+func (self *NativeSeeder) startSeed(file *File, metadata *Metadata) (*NativeSeed, int, error) {
+	for tries := 0; ; tries++ {
+		port, err := self.ports.acquire()
+		if err != nil {
+			return nil, 0, err
+		}
+		seed, err := StartNativeSeed(file.FQFN, metadata, port, self.Duration)
+		if err == nil {
+			return seed, port, nil
+		}
+		self.ports.release(port)
+		if _, ok := err.(*net.OpError); !ok || port == 0 || tries >= self.ports.size() {
+			return nil, 0, err
+		}
+		LogDebug("Seed port %d is busy, trying another.", port)
+	}
+}
+
+func (self *NativeSeeder) Start(file *File, metadata *Metadata) error {
+	self.supervisor.start(file, self.Restart, func(stop chan bool) error {
+		seed, port, err := self.startSeed(file, metadata)
+		if err != nil {
+			return err
+		}
+		defer self.ports.release(port)
+
+		select {
+		case <-seed.doneChannel:
+		case <-stop:
+			seed.Stop()
+			seed.Wait()
+		}
+		return nil
+	})
+	return nil
+}
+
+func (self *NativeSeeder) Stop(file *File) error {
+	self.supervisor.stop(file)
+	return nil
+}
+
+func (self *NativeSeeder) Status(file *File) SeedStatus {
+	return self.supervisor.status(file)
+}
+
+// StartNativeSeed begins seeding a file (or, for a multi-file torrent, the directory fqfn) on
+// the given port, or any free port if it is 0. The
+// seed exits on its own after duration has passed, or earlier if Stop is called.
+func StartNativeSeed(fqfn string, metadata *Metadata, port int,
+	duration time.Duration) (*NativeSeed, error) {
+	hashes, err := metadata.Info.SwarmHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := openStorage(fqfn, &metadata.Info)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+
+	seed := &NativeSeed{
+		Port:        listener.Addr().(*net.TCPAddr).Port,
+		name:        metadata.Info.Name,
+		storage:     data,
+		info:        &metadata.Info,
+		hashes:      hashes,
+		pieces:      metadata.Info.NumPieces(),
+		length:      metadata.Info.TotalLength(),
+		peerId:      makePeerId(),
+		announce:    metadata.Announce,
+		listener:    listener,
+		conns:       make(map[*seedConn]bool),
+		quitChannel: make(chan bool),
+		doneChannel: make(chan bool),
+	}
+	LogInfo("Seeding %s on port %d.", seed.name, seed.Port)
+
+	go seed.acceptLoop()
+	go seed.run(duration)
+	return seed, nil
+}
+
+// Stop asks the seed to exit. It returns immediately; use Wait to know when it's done.
+func (self *NativeSeed) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.quitChannel)
+	})
+}
+
+// Wait blocks until the seed has exited.
+func (self *NativeSeed) Wait() {
+	<-self.doneChannel
+}
+
+// run is the main lifecycle of the seed: announce periodically until we're told to quit or
+// our time is up, then tear everything down.
+func (self *NativeSeed) run(duration time.Duration) {
+	deadline := time.After(duration)
+	interval := self.sendAnnounce("started")
+	for running := true; running; {
+		select {
+		case <-time.After(interval):
+			interval = self.sendAnnounce("")
+		case <-deadline:
+			running = false
+		case <-self.quitChannel:
+			running = false
+		}
+	}
+
+	self.listener.Close()
+	self.lock.Lock()
+	for sc := range self.conns {
+		sc.conn.Close()
+	}
+	self.lock.Unlock()
+	self.sendAnnounce("stopped")
+	self.storage.Close()
+	LogInfo("Seed for %s exiting after uploading %d bytes.", self.name,
+		atomic.LoadInt64(&self.Uploaded))
+	close(self.doneChannel)
+}
+
+// sendAnnounce tells the tracker about us under each of our info_hashes and returns how long
+// to wait before the next announce.
+func (self *NativeSeed) sendAnnounce(event string) time.Duration {
+	interval := time.Duration(0)
+	for _, infoHash := range self.hashes {
+		if next := self.sendAnnounceFor(infoHash, event); interval == 0 || next < interval {
+			interval = next
+		}
+	}
+	return interval
+}
+
+// sendAnnounceFor announces a single info_hash.
+func (self *NativeSeed) sendAnnounceFor(infoHash []byte, event string) time.Duration {
+	values := url.Values{}
+	values.Set("info_hash", string(infoHash))
+	values.Set("peer_id", string(self.peerId))
+	values.Set("port", strconv.Itoa(self.Port))
+	values.Set("uploaded", strconv.FormatInt(atomic.LoadInt64(&self.Uploaded), 10))
+	values.Set("downloaded", "0")
+	values.Set("left", "0")
+	values.Set("numwant", "0")
+	if event != "" {
+		values.Set("event", event)
+	}
+
+	sep := "?"
+	if strings.Contains(self.announce, "?") {
+		sep = "&"
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(self.announce + sep + values.Encode())
+	if err != nil {
+		LogError("Seed for %s failed to announce: %s", self.name, err)
+		return 60 * time.Second
+	}
+	defer resp.Body.Close()
+
+	data, err := bencode.Decode(resp.Body)
+	if err != nil {
+		LogError("Seed for %s got invalid announce response: %s", self.name, err)
+		return 60 * time.Second
+	}
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		LogError("Seed for %s got invalid announce response.", self.name)
+		return 60 * time.Second
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		LogError("Seed for %s was refused by tracker: %s", self.name, reason)
+		return 60 * time.Second
+	}
+	if interval, ok := dict["interval"].(int64); ok && interval > 0 {
+		return time.Duration(interval) * time.Second
+	}
+	return 300 * time.Second
+}
+
+// acceptLoop takes new connections from peers until the listener is closed.
+func (self *NativeSeed) acceptLoop() {
+	for {
+		conn, err := self.listener.Accept()
+		if err != nil {
+			// Closing the listener is how we're told to stop.
+			return
+		}
+		go self.serveConn(conn)
+	}
+}
+
+// serveConn handles a single peer for the lifetime of its connection.
+func (self *NativeSeed) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	infoHash, _, err := readHandshake(conn)
+	if err != nil {
+		LogDebug("Handshake from %s failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+	known := false
+	for _, hash := range self.hashes {
+		known = known || bytes.Equal(infoHash, hash)
+	}
+	if !known {
+		LogDebug("Peer %s asked for an info_hash we don't serve.", conn.RemoteAddr())
+		return
+	}
+	if err := writeHandshake(conn, infoHash, self.peerId); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	sc := &seedConn{conn: conn, choked: true, closed: make(chan bool)}
+	if !self.addConn(sc) {
+		LogDebug("Too many peers for %s, dropping %s.", self.name, conn.RemoteAddr())
+		return
+	}
+	defer self.removeConn(sc)
+
+	if err := sc.send(&peerMessage{Id: msgBitfield, Payload: makeBitfield(self.pieces)}); err != nil {
+		return
+	}
+	LogDebug("Peer %s connected to seed for %s.", conn.RemoteAddr(), self.name)
+
+	// Keep the connection from looking idle to the peer while it's choked.
+	go func() {
+		ticker := time.NewTicker(90 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if sc.send(nil) != nil {
+					return
+				}
+			case <-sc.closed:
+				return
+			}
+		}
+	}()
+
+	for {
+		// Peers send a keep-alive every two minutes, so anything longer is a dead connection.
+		conn.SetReadDeadline(time.Now().Add(3 * time.Minute))
+		msg, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		if msg.KeepAlive {
+			continue
+		}
+
+		switch msg.Id {
+		case msgInterested:
+			self.setInterested(sc, true)
+		case msgNotInterested:
+			self.setInterested(sc, false)
+		case msgRequest:
+			if err := self.handleRequest(sc, msg.Payload); err != nil {
+				LogDebug("Dropping peer %s: %s", conn.RemoteAddr(), err)
+				return
+			}
+		case msgChoke, msgUnchoke, msgHave, msgBitfield, msgCancel:
+			// We never download and answer requests synchronously, so these are of no use.
+		default:
+			// Unknown messages are ignored per the spec.
+		}
+	}
+}
+
+// addConn registers a new peer connection, returning false if we already have too many.
+func (self *NativeSeed) addConn(sc *seedConn) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.conns) >= MAX_SEED_CONNECTIONS {
+		return false
+	}
+	self.conns[sc] = true
+	return true
+}
+
+// removeConn drops a peer connection and hands its upload slot to someone else.
+func (self *NativeSeed) removeConn(sc *seedConn) {
+	self.lock.Lock()
+	delete(self.conns, sc)
+	close(sc.closed)
+	var next *seedConn
+	if !sc.choked {
+		sc.choked = true
+		self.unchoked--
+		next = self.nextUnchoke()
+	}
+	self.lock.Unlock()
+
+	if next != nil {
+		next.send(&peerMessage{Id: msgUnchoke})
+	}
+}
+
+// setInterested records a peer's interest and unchokes or chokes it as appropriate.
+func (self *NativeSeed) setInterested(sc *seedConn, interested bool) {
+	var unchoke, choke *seedConn
+
+	self.lock.Lock()
+	sc.interested = interested
+	if interested && sc.choked && self.unchoked < MAX_UNCHOKED {
+		sc.choked = false
+		self.unchoked++
+		unchoke = sc
+	} else if !interested && !sc.choked {
+		sc.choked = true
+		self.unchoked--
+		choke = sc
+		unchoke = self.nextUnchoke()
+	}
+	self.lock.Unlock()
+
+	if choke != nil {
+		choke.send(&peerMessage{Id: msgChoke})
+	}
+	if unchoke != nil {
+		unchoke.send(&peerMessage{Id: msgUnchoke})
+	}
+}
+
+// nextUnchoke picks a choked but interested peer to give a free upload slot to, and marks it
+// unchoked. Must be called with the lock held. Returns nil if nobody is waiting.
+func (self *NativeSeed) nextUnchoke() *seedConn {
+	if self.unchoked >= MAX_UNCHOKED {
+		return nil
+	}
+	for sc := range self.conns {
+		if sc.choked && sc.interested {
+			sc.choked = false
+			self.unchoked++
+			return sc
+		}
+	}
+	return nil
+}
+
+// pieceSize returns the length of a given piece; only the last one may be short.
+func (self *NativeSeed) pieceSize(index int) int64 {
+	if index == self.pieces-1 {
+		return self.length - int64(index)*int64(self.info.PieceLength)
+	}
+	return int64(self.info.PieceLength)
+}
+
+// handleRequest reads the requested block from disk and sends it to the peer. An error means
+// the peer misbehaved badly enough to be dropped.
+func (self *NativeSeed) handleRequest(sc *seedConn, payload []byte) error {
+	index, begin, length, err := parseRequest(payload)
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	choked := sc.choked
+	self.lock.Unlock()
+	if choked {
+		// Requests from choked peers are discarded, they'll ask again when unchoked.
+		return nil
+	}
+
+	if int(index) >= self.pieces {
+		return errors.New(fmt.Sprintf("request for invalid piece %d", index))
+	}
+	if length == 0 || length > MAX_REQUEST_LENGTH ||
+		int64(begin)+int64(length) > self.pieceSize(int(index)) {
+		return errors.New(fmt.Sprintf("invalid request %d/%d/%d", index, begin, length))
+	}
+
+	block := make([]byte, length)
+	offset := int64(index)*int64(self.info.PieceLength) + int64(begin)
+	if _, err := self.storage.ReadAt(block, offset); err != nil {
+		LogError("Seed for %s failed to read: %s", self.name, err)
+		return err
+	}
+
+	if err := sc.send(&peerMessage{Id: msgPiece, Payload: makePiece(index, begin, block)}); err != nil {
+		return err
+	}
+	atomic.AddInt64(&self.Uploaded, int64(length))
+	return nil
+}
@@ -0,0 +1,111 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAnnounce answers every announce with a fixed interval and no peers.
+func fakeAnnounce(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("d8:intervali300e5:peerslee"))
+}
+
+func TestNativeSeedServesPieces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fqfn := filepath.Join(dir, "data.bin")
+	data := bytes.Repeat([]byte("0123456789"), int(testPieceLength/10)+100)
+	assert.Nil(t, ioutil.WriteFile(fqfn, data, 0644))
+
+	options := DefaultMetadataOptions
+	options.PieceLength = testPieceLength
+	mdinfo, err := GenerateMetadataInfo(fqfn, options)
+	assert.Nil(t, err)
+	infoHash, err := mdinfo.InfoHash()
+	assert.Nil(t, err)
+
+	tracker := httptest.NewServer(http.HandlerFunc(fakeAnnounce))
+	defer tracker.Close()
+
+	seed, err := StartNativeSeed(fqfn, &Metadata{Announce: tracker.URL, Info: *mdinfo}, 0, time.Minute)
+	assert.Nil(t, err)
+	defer func() {
+		seed.Stop()
+		seed.Wait()
+	}()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(seed.Port))
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	assert.Nil(t, writeHandshake(conn, infoHash, makePeerId()))
+	gotHash, _, err := readHandshake(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, infoHash, gotHash)
+
+	msg, err := readMessage(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, msgBitfield, msg.Id)
+	assert.Equal(t, []byte{0xc0}, msg.Payload, "two pieces, spare bits clear")
+
+	assert.Nil(t, writeMessage(conn, &peerMessage{Id: msgInterested}))
+	msg, err = readMessage(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, msgUnchoke, msg.Id)
+
+	// Ask for the start of the short final piece.
+	request := make([]byte, 12)
+	binary.BigEndian.PutUint32(request[0:4], 1)
+	binary.BigEndian.PutUint32(request[4:8], 0)
+	binary.BigEndian.PutUint32(request[8:12], 900)
+	assert.Nil(t, writeMessage(conn, &peerMessage{Id: msgRequest, Payload: request}))
+
+	msg, err = readMessage(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, msgPiece, msg.Id)
+	assert.Equal(t, makePiece(1, 0, data[testPieceLength:testPieceLength+900]), msg.Payload)
+}
+
+func TestNativeSeedRejectsWrongInfoHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fqfn := filepath.Join(dir, "data.bin")
+	assert.Nil(t, ioutil.WriteFile(fqfn, []byte("testing"), 0644))
+	mdinfo, err := GenerateMetadataInfo(fqfn, DefaultMetadataOptions)
+	assert.Nil(t, err)
+
+	tracker := httptest.NewServer(http.HandlerFunc(fakeAnnounce))
+	defer tracker.Close()
+
+	seed, err := StartNativeSeed(fqfn, &Metadata{Announce: tracker.URL, Info: *mdinfo}, 0, time.Minute)
+	assert.Nil(t, err)
+	defer func() {
+		seed.Stop()
+		seed.Wait()
+	}()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(seed.Port))
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	assert.Nil(t, writeHandshake(conn, bytes.Repeat([]byte{1}, 20), makePeerId()))
+	_, _, err = readHandshake(conn)
+	assert.NotNil(t, err, "connection should be closed without a handshake")
+}
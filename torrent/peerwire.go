@@ -0,0 +1,149 @@
+/*
+ * peerwire.go
+ *
+ * Encoding and decoding of the BitTorrent peer wire protocol (BEP 3). Only the subset of the
+ * protocol that a seeder needs is implemented here.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const PROTOCOL_NAME = "BitTorrent protocol"
+
+// Peer wire message IDs. A message with no ID (zero length) is a keep-alive.
+const (
+	msgChoke         = byte(0)
+	msgUnchoke       = byte(1)
+	msgInterested    = byte(2)
+	msgNotInterested = byte(3)
+	msgHave          = byte(4)
+	msgBitfield      = byte(5)
+	msgRequest       = byte(6)
+	msgPiece         = byte(7)
+	msgCancel        = byte(8)
+)
+
+// Largest block we will serve for a single request. Clients use 16KB; the spec suggests
+// closing connections that ask for more than 128KB.
+const MAX_REQUEST_LENGTH = 128 * 1024
+
+// Largest message we're willing to read from a peer. The only big message a peer sends a
+// seeder is its bitfield, which is tiny compared to this.
+const MAX_MESSAGE_LENGTH = 1024 * 1024
+
+// peerMessage is a single decoded message. A keep-alive is represented by KeepAlive being true
+// and everything else empty.
+type peerMessage struct {
+	KeepAlive bool
+	Id        byte
+	Payload   []byte
+}
+
+// writeHandshake sends the opening handshake for a given info_hash and peer_id.
+func writeHandshake(w io.Writer, infoHash, peerId []byte) error {
+	buf := make([]byte, 0, 68)
+	buf = append(buf, byte(len(PROTOCOL_NAME)))
+	buf = append(buf, PROTOCOL_NAME...)
+	buf = append(buf, make([]byte, 8)...) // Reserved bytes; we support no extensions.
+	buf = append(buf, infoHash...)
+	buf = append(buf, peerId...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readHandshake reads the opening handshake from a peer and returns the info_hash and peer_id
+// the peer sent.
+func readHandshake(r io.Reader) ([]byte, []byte, error) {
+	var pstrlen [1]byte
+	if _, err := io.ReadFull(r, pstrlen[:]); err != nil {
+		return nil, nil, err
+	}
+	if int(pstrlen[0]) != len(PROTOCOL_NAME) {
+		return nil, nil, errors.New("unknown protocol in handshake")
+	}
+
+	buf := make([]byte, len(PROTOCOL_NAME)+8+20+20)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(buf[:len(PROTOCOL_NAME)], []byte(PROTOCOL_NAME)) {
+		return nil, nil, errors.New("unknown protocol in handshake")
+	}
+	buf = buf[len(PROTOCOL_NAME)+8:]
+	return buf[:20], buf[20:], nil
+}
+
+// readMessage reads one length-prefixed message from a peer.
+func readMessage(r io.Reader) (*peerMessage, error) {
+	var lenbuf [4]byte
+	if _, err := io.ReadFull(r, lenbuf[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lenbuf[:])
+	if length == 0 {
+		return &peerMessage{KeepAlive: true}, nil
+	}
+	if length > MAX_MESSAGE_LENGTH {
+		return nil, errors.New(fmt.Sprintf("message too long: %d", length))
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return &peerMessage{Id: buf[0], Payload: buf[1:]}, nil
+}
+
+// writeMessage sends one message to a peer. A nil message is sent as a keep-alive.
+func writeMessage(w io.Writer, msg *peerMessage) error {
+	if msg == nil || msg.KeepAlive {
+		_, err := w.Write([]byte{0, 0, 0, 0})
+		return err
+	}
+	buf := make([]byte, 5+len(msg.Payload))
+	binary.BigEndian.PutUint32(buf, uint32(1+len(msg.Payload)))
+	buf[4] = msg.Id
+	copy(buf[5:], msg.Payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// makeBitfield returns a bitfield payload with all of the given number of pieces set. The
+// spare bits at the end are cleared, as required by the spec.
+func makeBitfield(numPieces int) []byte {
+	bitfield := make([]byte, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		bitfield[i/8] |= 0x80 >> uint(i%8)
+	}
+	return bitfield
+}
+
+// parseRequest decodes the payload of a request (or cancel) message.
+func parseRequest(payload []byte) (uint32, uint32, uint32, error) {
+	if len(payload) != 12 {
+		return 0, 0, 0, errors.New("invalid request length")
+	}
+	return binary.BigEndian.Uint32(payload[0:4]),
+		binary.BigEndian.Uint32(payload[4:8]),
+		binary.BigEndian.Uint32(payload[8:12]), nil
+}
+
+// makePiece builds the payload of a piece message.
+func makePiece(index, begin uint32, block []byte) []byte {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], index)
+	binary.BigEndian.PutUint32(payload[4:8], begin)
+	copy(payload[8:], block)
+	return payload
+}
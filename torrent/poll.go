@@ -0,0 +1,143 @@
+/*
+ * poll.go
+ *
+ * Finds changes to a watched directory by scanning it every so often, for filesystems fsnotify
+ * doesn't work on (NFS, FUSE) and for when we run out of inotify watches.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How often a directory is scanned when it can't be watched, unless the watcher's PollInterval
+// says otherwise.
+const POLL_INTERVAL = 30 * time.Second
+
+// pollState is what a scan records about each file, to tell whether it changed.
+type pollState struct {
+	size    int64
+	modTime int64 // In nanoseconds.
+	inode   uint64
+}
+
+// isPolling says whether we're scanning for changes, instead of or as well as using fsnotify.
+func (self *Watcher) isPolling() bool {
+	return atomic.LoadInt32(&self.polling) != 0
+}
+
+// startPolling starts scanning our directory for changes, if we aren't already.
+func (self *Watcher) startPolling(updates chan fsnotify.Event) {
+	self.pollOnce.Do(func() {
+		atomic.StoreInt32(&self.polling, 1)
+		go self.poll(updates)
+	})
+}
+
+// poll scans our directory every PollInterval and sends the changes it finds to updates, as if
+// fsnotify had, until the watcher is closed. The first scan only records what's there, since
+// the files were found by walking the directory already.
+func (self *Watcher) poll(updates chan fsnotify.Event) {
+	interval := self.Options.PollInterval
+	if interval <= 0 {
+		interval = POLL_INTERVAL
+	}
+	LogInfo("Scanning %s for changes every %s.", self.Directory, interval)
+
+	last := self.scan()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.QuitChannel:
+			return
+		}
+		current := self.scan()
+		for _, ev := range self.pollEvents(last, current) {
+			select {
+			case updates <- ev:
+			case <-self.QuitChannel:
+				return
+			}
+		}
+		last = current
+	}
+}
+
+// scan returns the state of every file under our directory, by path relative to it.
+func (self *Watcher) scan() map[string]pollState {
+	files := make(map[string]pollState)
+	self.walk(self.Directory, false, func(fqfn string) bool {
+		if info, err := os.Stat(fqfn); err == nil {
+			files[fqfn[len(self.Directory)+1:]] = pollState{
+				size:    info.Size(),
+				modTime: info.ModTime().UnixNano(),
+				inode:   fileInode(info),
+			}
+		}
+		return true
+	})
+	return files
+}
+
+// pollEvents returns the events fsnotify would have sent for the changes between two scans, and
+// for the files we're serving that the last scan didn't find. Staging files that went away
+// while a file with the same inode appeared under their final name were renamed into place, so
+// they get Rename events. Removals and renames come first, as they would from fsnotify.
+func (self *Watcher) pollEvents(last, current map[string]pollState) []fsnotify.Event {
+	var removed, changed []fsnotify.Event
+	for localfn, state := range last {
+		if _, ok := current[localfn]; ok {
+			continue
+		}
+		op := fsnotify.Remove
+		if final := self.Options.unstaged(localfn); final != "" && state.inode != 0 {
+			if renamed, ok := current[final]; ok && renamed.inode == state.inode {
+				op = fsnotify.Rename
+			}
+		}
+		removed = append(removed, fsnotify.Event{Name: filepath.Join(self.Directory, localfn),
+			Op: op})
+	}
+
+	self.FilesLock.Lock()
+	for localfn := range self.Files {
+		_, seen := last[localfn]
+		if _, ok := current[localfn]; !ok && !seen {
+			removed = append(removed,
+				fsnotify.Event{Name: filepath.Join(self.Directory, localfn), Op: fsnotify.Remove})
+		}
+	}
+	self.FilesLock.Unlock()
+
+	for localfn, state := range current {
+		if previous, ok := last[localfn]; !ok {
+			changed = append(changed,
+				fsnotify.Event{Name: filepath.Join(self.Directory, localfn), Op: fsnotify.Create})
+		} else if previous != state {
+			changed = append(changed,
+				fsnotify.Event{Name: filepath.Join(self.Directory, localfn), Op: fsnotify.Write})
+		}
+	}
+
+	sortEvents(removed)
+	sortEvents(changed)
+	return append(removed, changed...)
+}
+
+// sortEvents sorts events by name, so they're sent in a predictable order.
+func sortEvents(events []fsnotify.Event) {
+	sort.Slice(events, func(i, j int) bool { return events[i].Name < events[j].Name })
+}
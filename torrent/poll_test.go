@@ -0,0 +1,110 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollEvents(t *testing.T) {
+	watcher := &Watcher{
+		Directory: "/srv",
+		Files:     map[string]*File{"gone": {}, "kept": {}},
+		Options:   WatcherOptions{StagingSuffixes: []string{".part"}},
+	}
+	last := map[string]pollState{
+		"kept":        {size: 1, modTime: 1, inode: 1},
+		"changed":     {size: 1, modTime: 1, inode: 2},
+		"deleted":     {size: 1, modTime: 1, inode: 3},
+		"upload.part": {size: 1, modTime: 1, inode: 4},
+		"other.part":  {size: 1, modTime: 1, inode: 5},
+	}
+	current := map[string]pollState{
+		"kept":    {size: 1, modTime: 1, inode: 1},
+		"changed": {size: 1, modTime: 2, inode: 2},
+		"upload":  {size: 1, modTime: 1, inode: 4},
+		"other":   {size: 1, modTime: 1, inode: 6},
+	}
+	assert.Equal(t, []fsnotify.Event{
+		{Name: "/srv/deleted", Op: fsnotify.Remove},
+		{Name: "/srv/gone", Op: fsnotify.Remove}, // Being served, but not found.
+		{Name: "/srv/other.part", Op: fsnotify.Remove},
+		{Name: "/srv/upload.part", Op: fsnotify.Rename},
+		{Name: "/srv/changed", Op: fsnotify.Write},
+		{Name: "/srv/other", Op: fsnotify.Create},
+		{Name: "/srv/upload", Op: fsnotify.Create},
+	}, watcher.pollEvents(last, current))
+
+	// Files we're serving keep getting Remove events until they're forgotten.
+	assert.Len(t, watcher.pollEvents(current, current), 1)
+	delete(watcher.Files, "gone")
+	assert.Empty(t, watcher.pollEvents(current, current))
+}
+
+func TestWatcherPolling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "old"), []byte("old"), 0644))
+
+	ready := make(chan *File, 100)
+	watcher := StartWatcher(dir, DefaultMetadataOptions, WatcherOptions{
+		PollInterval:    20 * time.Millisecond,
+		StagingSuffixes: []string{".part"},
+	}, ready, nil)
+	defer watcher.Close()
+	assert.Nil(t, watcher.Watcher)
+	assert.Equal(t, "old", (<-ready).Name)
+
+	// New files are found, if they're renamed into place.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "inplace"), []byte("data"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "new.part"), []byte("data"), 0644))
+	time.Sleep(100 * time.Millisecond) // Long enough for a few scans to see the staging file.
+	assert.Nil(t, os.Rename(filepath.Join(dir, "new.part"), filepath.Join(dir, "new")))
+	assert.Equal(t, "new", (<-ready).Name)
+	assert.Nil(t, watcher.GetFile("inplace"))
+
+	// Changes are noticed too, as are deletions.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "old"), []byte("changed"), 0644))
+	file := <-ready
+	assert.Equal(t, "old", file.Name)
+	assert.Equal(t, int64(7), file.Size)
+	assert.Nil(t, os.Remove(filepath.Join(dir, "old")))
+	waitFor(t, "deleted file to be forgotten", func() bool {
+		return watcher.GetFile("old") == nil
+	})
+}
+
+func TestWatcherPollsWhenWatchFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+
+	// Adding watches fails once the fsnotify watcher is closed, as when we're out of watches.
+	fswatcher, err := fsnotify.NewWatcher()
+	assert.Nil(t, err)
+	fswatcher.Close()
+	watcher := &Watcher{
+		Watcher:     fswatcher,
+		Directory:   dir,
+		Files:       map[string]*File{"file": {}},
+		QuitChannel: make(chan bool),
+		Options:     WatcherOptions{PollInterval: 10 * time.Millisecond},
+	}
+	defer watcher.Close()
+
+	updates := make(chan fsnotify.Event, 10)
+	watcher.walkAndWatch(dir, updates)
+	assert.True(t, watcher.isPolling())
+	assert.Equal(t, fsnotify.Event{Name: filepath.Join(dir, "file")}, <-updates)
+
+	assert.Nil(t, os.Remove(filepath.Join(dir, "file")))
+	assert.Equal(t, fsnotify.Event{Name: filepath.Join(dir, "file"), Op: fsnotify.Remove},
+		<-updates)
+}
@@ -0,0 +1,116 @@
+/*
+ * reaper.go
+ *
+ * Drops peers that have stopped announcing (they crashed, or went away without saying so)
+ * and swarms with no peers left, so the tracker doesn't grow forever.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"time"
+)
+
+// How often the reaper runs, by default.
+const REAP_INTERVAL = 1 * time.Minute
+
+// swarmForgetter is implemented by PeerSelectors that keep state for each swarm, so they can
+// drop it when the swarm goes away.
+type swarmForgetter interface {
+	Forget(info_hash string)
+}
+
+// peerTTL returns how long peers stay in the swarm without announcing.
+func (self *Tracker) peerTTL() time.Duration {
+	if self.options.PeerTTL > 0 {
+		return self.options.PeerTTL
+	}
+	return PEER_TIMEOUT
+}
+
+// startReaper starts the goroutine that reaps peers until the tracker is closed.
+func (self *Tracker) startReaper() {
+	interval := self.options.ReapInterval
+	if interval <= 0 {
+		interval = REAP_INTERVAL
+	}
+	self.reaperDone = make(chan bool)
+
+	go func() {
+		defer close(self.reaperDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				self.reap(time.Now())
+			case <-self.quitChan:
+				return
+			}
+		}
+	}()
+}
+
+// reap drops the peers that haven't announced in peerTTL as of now, and the swarms that are
+// left empty. Their completed counts are kept while we still serve the file, so scrapes can
+// show that a fleet has finished. Returns how many peers and swarms it dropped.
+func (self *Tracker) reap(now time.Time) (int, int) {
+	self.peerListLock.Lock()
+	defer self.peerListLock.Unlock()
+
+	peers, swarms := 0, 0
+	for info_hash, peerseen := range self.PeerSeen {
+		for id, seen := range peerseen {
+			if now.Sub(seen) > self.peerTTL() {
+				delete(peerseen, id)
+				delete(self.PeerList[info_hash], id)
+				peers++
+			}
+		}
+	}
+
+	// Swarms can exist in one map but not the other, e.g. after every peer has stopped.
+	for _, info_hash := range self.swarmHashes() {
+		if len(self.PeerList[info_hash]) > 0 || len(self.PeerSeen[info_hash]) > 0 {
+			continue
+		}
+		delete(self.PeerList, info_hash)
+		delete(self.PeerSeen, info_hash)
+		if forgetter, ok := self.options.Selector.(swarmForgetter); ok {
+			forgetter.Forget(info_hash)
+		}
+		swarms++
+	}
+	for info_hash := range self.Completed {
+		_, listed := self.PeerList[info_hash]
+		_, seen := self.PeerSeen[info_hash]
+		served := self.registry != nil && self.registry.Lookup(info_hash) != nil
+		if !listed && !seen && !served {
+			delete(self.Completed, info_hash)
+		}
+	}
+
+	if peers > 0 || swarms > 0 {
+		LogInfo("Reaped %d stale peers and %d empty swarms.", peers, swarms)
+	}
+	return peers, swarms
+}
+
+// swarmHashes returns the info_hash of every swarm we know about. Must be called with
+// peerListLock held.
+func (self *Tracker) swarmHashes() []string {
+	var info_hashes []string
+	for info_hash := range self.PeerList {
+		info_hashes = append(info_hashes, info_hash)
+	}
+	for info_hash := range self.PeerSeen {
+		if _, ok := self.PeerList[info_hash]; !ok {
+			info_hashes = append(info_hashes, info_hash)
+		}
+	}
+	return info_hashes
+}
@@ -0,0 +1,94 @@
+package torrent
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReaper(t *testing.T) {
+	tracker := newTestTracker()
+	selector := NewLeastRecentSelector()
+	tracker.options = TrackerOptions{PeerTTL: time.Minute, Selector: selector}
+
+	stale, fresh := strings.Repeat("s", 20), strings.Repeat("f", 20)
+	announce(t, tracker, "10.0.0.1:5000", url.Values{"peer_id": {"a"}, "port": {"1"},
+		"info_hash": {stale}, "event": {"completed"}})
+	announce(t, tracker, "10.0.0.2:5000", url.Values{"peer_id": {"b"}, "port": {"1"},
+		"info_hash": {fresh}})
+	announce(t, tracker, "10.0.0.3:5000", url.Values{"peer_id": {"c"}, "port": {"1"},
+		"info_hash": {fresh}})
+	tracker.PeerSeen[stale]["a"] = time.Now().Add(-2 * time.Minute)
+	tracker.PeerSeen[fresh]["b"] = time.Now().Add(-2 * time.Minute)
+
+	peers, swarms := tracker.reap(time.Now())
+	assert.Equal(t, 2, peers)
+	assert.Equal(t, 1, swarms)
+	assert.NotContains(t, tracker.PeerList, stale)
+	assert.NotContains(t, tracker.PeerSeen, stale)
+	assert.NotContains(t, tracker.Completed, stale)
+	assert.NotContains(t, selector.handout, stale)
+	assert.Equal(t, []string{"c"}, peerIds(tracker.PeerList[fresh]))
+
+	// Swarms whose peers all stopped are empty too.
+	announce(t, tracker, "10.0.0.3:5000", url.Values{"peer_id": {"c"}, "port": {"1"},
+		"info_hash": {fresh}, "event": {"stopped"}})
+	peers, swarms = tracker.reap(time.Now())
+	assert.Equal(t, 0, peers)
+	assert.Equal(t, 1, swarms)
+	assert.Empty(t, tracker.PeerList)
+	assert.Empty(t, tracker.PeerSeen)
+}
+
+func TestReaperKeepsCompletedWhileServed(t *testing.T) {
+	tracker := newTestTracker()
+	tracker.options = TrackerOptions{PeerTTL: time.Minute}
+	tracker.registry = NewRegistry()
+	file := &File{Name: "file"}
+	mdinfo := &MetadataInfo{Name: "file", PieceLength: 16384, Pieces: strings.Repeat("p", 20),
+		Length: 1}
+	assert.Nil(t, tracker.registry.Register(file, mdinfo))
+	hash, err := mdinfo.InfoHash()
+	assert.Nil(t, err)
+
+	// The whole fleet finished and went away.
+	announce(t, tracker, "10.0.0.1:5000", url.Values{"peer_id": {"a"}, "port": {"1"},
+		"info_hash": {string(hash)}, "event": {"completed"}})
+	tracker.PeerSeen[string(hash)]["a"] = time.Now().Add(-2 * time.Minute)
+	peers, swarms := tracker.reap(time.Now())
+	assert.Equal(t, 1, peers)
+	assert.Equal(t, 1, swarms)
+	assert.Equal(t, ScrapeFile{Downloaded: 1}, tracker.Scrape(nil)[string(hash)])
+
+	// Once we stop serving the file, its count goes too.
+	tracker.registry.Unregister(file)
+	tracker.reap(time.Now())
+	assert.Empty(t, tracker.Completed)
+	assert.Empty(t, tracker.Scrape(nil))
+}
+
+func peerIds(peers map[string]Peer) []string {
+	var ids []string
+	for id := range peers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestReaperShutsDown(t *testing.T) {
+	tracker := newTestTracker()
+	tracker.options.ReapInterval = time.Millisecond
+	tracker.startReaper()
+
+	time.Sleep(10 * time.Millisecond)
+	tracker.Close()
+	tracker.Close() // Closing twice is fine.
+	select {
+	case <-tracker.reaperDone:
+	default:
+		t.Error("reaper still running")
+	}
+}
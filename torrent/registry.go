@@ -0,0 +1,126 @@
+/*
+ * registry.go
+ *
+ * Keeps track of the info_hashes of every torrent we serve, so the tracker only runs swarms for
+ * those (and for an optional whitelist of outside torrents) instead of for anything a client
+ * cares to announce.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Registry maps the swarm hashes (20 bytes; v2 info_hashes are truncated) of the torrents our
+// watchers have generated to the files they're for. Watchers keep it up to date as metadata is
+// generated and files go away.
+type Registry struct {
+	lock   sync.Mutex
+	files  map[string]*File   // By swarm hash.
+	hashes map[*File][]string // The swarm hashes of each file's current metadata.
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		files:  make(map[string]*File),
+		hashes: make(map[*File][]string),
+	}
+}
+
+// Register records the swarm hashes of a file's new metadata, replacing those of its old
+// metadata, if any.
+func (self *Registry) Register(file *File, mdinfo *MetadataInfo) error {
+	hashes, err := mdinfo.SwarmHashes()
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.unregister(file)
+	for _, hash := range hashes {
+		self.files[string(hash)] = file
+		self.hashes[file] = append(self.hashes[file], string(hash))
+	}
+	return nil
+}
+
+// Unregister forgets a file's swarm hashes, when it's deleted or changed.
+func (self *Registry) Unregister(file *File) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.unregister(file)
+}
+
+func (self *Registry) unregister(file *File) {
+	for _, hash := range self.hashes[file] {
+		if self.files[hash] == file {
+			delete(self.files, hash)
+		}
+	}
+	delete(self.hashes, file)
+}
+
+// Lookup returns the file that a swarm hash is for, or nil if it isn't one of ours.
+func (self *Registry) Lookup(info_hash string) *File {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.files[info_hash]
+}
+
+// parseInfoHash turns a hex info_hash (40 characters for v1, 64 for v2) into the 20 bytes we
+// key swarms by.
+func parseInfoHash(value string) (string, error) {
+	hash, err := hex.DecodeString(value)
+	if err != nil || (len(hash) != 20 && len(hash) != 32) {
+		return "", errors.New(fmt.Sprintf("invalid info_hash %q", value))
+	}
+	return string(hash[:20]), nil
+}
+
+// LoadWhitelist reads a file of hex info_hashes, one per line, for torrents we didn't generate
+// but should track anyway. Blank lines and anything after a # are ignored.
+func LoadWhitelist(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	whitelist := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		info_hash, err := parseInfoHash(line)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s:%d: %s", path, lineno, err))
+		}
+		whitelist[info_hash] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	LogInfo("Loaded %d whitelisted info_hashes from %s", len(whitelist), path)
+	return whitelist, nil
+}
@@ -0,0 +1,60 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	file := &File{Name: "file"}
+	mdinfo := &MetadataInfo{Name: "file", PieceLength: 16384, Pieces: strings.Repeat("p", 20),
+		Length: 1}
+	hash, err := mdinfo.InfoHash()
+	assert.Nil(t, err)
+
+	assert.Nil(t, registry.Lookup(string(hash)))
+	assert.Nil(t, registry.Register(file, mdinfo))
+	assert.Equal(t, file, registry.Lookup(string(hash)))
+
+	// New metadata replaces the old.
+	changed := *mdinfo
+	changed.Length = 2
+	assert.Nil(t, registry.Register(file, &changed))
+	newHash, err := changed.InfoHash()
+	assert.Nil(t, err)
+	assert.Nil(t, registry.Lookup(string(hash)))
+	assert.Equal(t, file, registry.Lookup(string(newHash)))
+
+	registry.Unregister(file)
+	assert.Nil(t, registry.Lookup(string(newHash)))
+	assert.Empty(t, registry.files)
+	assert.Empty(t, registry.hashes)
+}
+
+func TestLoadWhitelist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	v1 := strings.Repeat("ab", 20)
+	v2 := strings.Repeat("cd", 32)
+	path := filepath.Join(dir, "whitelist")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("# Outside torrents.\n"+v1+"\n\n"+
+		strings.ToUpper(v2)+"  # v2 hashes are truncated\n"), 0644))
+	whitelist, err := LoadWhitelist(path)
+	assert.Nil(t, err)
+	hash1, _ := hex.DecodeString(v1)
+	hash2, _ := hex.DecodeString(v2)
+	assert.Equal(t, map[string]bool{string(hash1): true, string(hash2[:20]): true}, whitelist)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("abcd\n"), 0644))
+	_, err = LoadWhitelist(path)
+	assert.NotNil(t, err, "too short")
+}
@@ -0,0 +1,182 @@
+/*
+ * seeder.go
+ *
+ * The interface the tracker uses to get files seeded, plus a no-op implementation for nodes
+ * that should only run the tracker.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SeedState is the lifecycle state of a file's seed.
+type SeedState string
+
+const (
+	SeedIdle    = SeedState("idle")    // Never seeded (or the seeder doesn't track it).
+	SeedRunning = SeedState("running") // Currently seeding.
+	SeedExited  = SeedState("exited")  // Last seed finished cleanly, or was stopped.
+	SeedFailed  = SeedState("failed")  // Last seed crashed; it may be waiting to restart.
+)
+
+// SeedStatus describes what a Seeder is doing for a given file.
+type SeedStatus struct {
+	State     SeedState     `json:"state"`
+	Started   time.Time     `json:"started"`    // When the current (or last) run began.
+	Runtime   time.Duration `json:"runtime_ns"` // How long the current (or last) run lasted.
+	ExitCode  int           `json:"exit_code"`  // Exit code of the last run, if it was a process.
+	Restarts  int           `json:"restarts"`   // Restarts since the last clean start.
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// Running returns whether the seed is currently active.
+func (self SeedStatus) Running() bool {
+	return self.State == SeedRunning
+}
+
+// Seeder is responsible for making sure there is at least one complete copy of a file in the
+// swarm. The tracker calls Start whenever someone asks for a torrent; implementations must
+// treat repeated calls for a file that's already seeding as a no-op. All methods must be safe
+// to call from multiple goroutines.
+type Seeder interface {
+	// Start begins seeding a file described by the given metadata.
+	Start(file *File, metadata *Metadata) error
+
+	// Stop ends seeding of a file. Stopping a file that isn't seeding is not an error.
+	Stop(file *File) error
+
+	// Status reports the current seeding state of a file.
+	Status(file *File) SeedStatus
+}
+
+// SeedPolicy controls how and when files get seeded.
+type SeedPolicy struct {
+	Duration time.Duration // How long each seed runs before exiting.
+	MinPort  int           // First port seeds may listen on. 0 lets the seeder choose.
+	MaxPort  int           // Last port seeds may listen on.
+	MaxSeeds int           // Most seeds at once; the least recently requested is stopped. 0 is no limit.
+	Eager    bool          // Seed files as soon as their metadata is ready, not on first request.
+}
+
+// DefaultSeedPolicy seeds on request for four hours at a time, like we always have.
+var DefaultSeedPolicy = SeedPolicy{
+	Duration: SEED_DURATION,
+}
+
+// Validate checks the policy for obvious mistakes.
+func (self SeedPolicy) Validate() error {
+	if self.Duration <= 0 {
+		return errors.New("seed duration must be positive")
+	}
+	if self.MinPort != 0 || self.MaxPort != 0 {
+		if self.MinPort < 1 || self.MaxPort > 65535 || self.MinPort > self.MaxPort {
+			return errors.New("seed ports must be a range within 1..65535")
+		}
+		if self.MaxSeeds > self.MaxPort-self.MinPort+1 {
+			return errors.New(fmt.Sprintf("seed port range only has room for %d seeds",
+				self.MaxPort-self.MinPort+1))
+		}
+	}
+	if self.MaxSeeds < 0 {
+		return errors.New("max seeds can't be negative")
+	}
+	return nil
+}
+
+// PolicySeeder is implemented by seeders that can honor the duration and port range of a
+// SeedPolicy. The Distributor hands its policy to them before seeding starts.
+type PolicySeeder interface {
+	Seeder
+	SetSeedPolicy(policy SeedPolicy)
+}
+
+// SeedOptions are the per-seed settings given to a command that seeds a file.
+type SeedOptions struct {
+	Port     int           // Port to listen on; 0 means the client's default.
+	Duration time.Duration // How long to seed for.
+}
+
+// portPool hands out ports from a range so concurrent seeds don't fight over one port. A pool
+// with no range always hands out 0, letting the seed pick.
+type portPool struct {
+	lock     sync.Mutex
+	min, max int
+	next     int
+	used     map[int]bool
+}
+
+func newPortPool(min, max int) *portPool {
+	return &portPool{
+		min:  min,
+		max:  max,
+		next: min,
+		used: make(map[int]bool),
+	}
+}
+
+// acquire reserves a port. Ports are handed out round-robin so a port that turned out to be
+// busy isn't immediately given out again.
+func (self *portPool) acquire() (int, error) {
+	if self == nil || self.min == 0 {
+		return 0, nil
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i := self.min; i <= self.max; i++ {
+		port := self.next
+		if self.next++; self.next > self.max {
+			self.next = self.min
+		}
+		if !self.used[port] {
+			self.used[port] = true
+			return port, nil
+		}
+	}
+	return 0, errors.New(fmt.Sprintf("all seed ports in %d-%d are in use", self.min, self.max))
+}
+
+// release returns a port to the pool.
+func (self *portPool) release(port int) {
+	if self == nil || port == 0 {
+		return
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.used, port)
+}
+
+// size is the number of ports in the pool, or 0 if it's unrestricted.
+func (self *portPool) size() int {
+	if self == nil || self.min == 0 {
+		return 0
+	}
+	return self.max - self.min + 1
+}
+
+// NullSeeder never seeds anything. Use it for tracker-only nodes where the files are seeded
+// by some other machine.
+type NullSeeder struct{}
+
+func (self NullSeeder) Start(file *File, metadata *Metadata) error {
+	return nil
+}
+
+func (self NullSeeder) Stop(file *File) error {
+	return nil
+}
+
+func (self NullSeeder) Status(file *File) SeedStatus {
+	return SeedStatus{State: SeedIdle}
+}
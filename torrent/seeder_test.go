@@ -0,0 +1,140 @@
+package torrent
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSeeder records which files it has been asked to seed.
+type fakeSeeder struct {
+	lock    sync.Mutex
+	running map[*File]bool
+	started []*File
+}
+
+func newFakeSeeder() *fakeSeeder {
+	return &fakeSeeder{running: make(map[*File]bool)}
+}
+
+func (self *fakeSeeder) Start(file *File, metadata *Metadata) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.running[file] {
+		self.running[file] = true
+		self.started = append(self.started, file)
+	}
+	return nil
+}
+
+func (self *fakeSeeder) Stop(file *File) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.running, file)
+	return nil
+}
+
+func (self *fakeSeeder) Status(file *File) SeedStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.running[file] {
+		return SeedStatus{State: SeedRunning}
+	}
+	return SeedStatus{State: SeedIdle}
+}
+
+func TestSeedPolicyValidate(t *testing.T) {
+	assert.Nil(t, DefaultSeedPolicy.Validate())
+	assert.Nil(t, SeedPolicy{Duration: time.Hour, MinPort: 6881, MaxPort: 6889, MaxSeeds: 9}.Validate())
+	assert.NotNil(t, SeedPolicy{}.Validate(), "needs a duration")
+	assert.NotNil(t, SeedPolicy{Duration: time.Hour, MinPort: 6889, MaxPort: 6881}.Validate())
+	assert.NotNil(t, SeedPolicy{Duration: time.Hour, MinPort: 6881, MaxPort: 6889, MaxSeeds: 10}.Validate(),
+		"more seeds than ports")
+}
+
+func TestPortPool(t *testing.T) {
+	pool := newPortPool(7000, 7001)
+	first, err := pool.acquire()
+	assert.Nil(t, err)
+	second, err := pool.acquire()
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+
+	_, err = pool.acquire()
+	assert.NotNil(t, err, "pool should be exhausted")
+
+	pool.release(first)
+	port, err := pool.acquire()
+	assert.Nil(t, err)
+	assert.Equal(t, first, port)
+
+	// An unrestricted pool lets the seed pick.
+	port, err = newPortPool(0, 0).acquire()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, port)
+}
+
+// servingWatcher returns a watcher serving files, as if it had found them in /srv.
+func servingWatcher(files ...*File) *Watcher {
+	watcher := &Watcher{
+		Directory: "/srv",
+		Files:     make(map[string]*File),
+		Dirs:      make(map[string]*File),
+	}
+	for _, file := range files {
+		file.FQFN = "/srv/" + file.Name
+		watcher.Files[file.Name] = file
+	}
+	return watcher
+}
+
+func TestTrackerEvictsLeastRecentlyRequestedSeed(t *testing.T) {
+	seeder := newFakeSeeder()
+	md := &Metadata{}
+	a, b, c := &File{Name: "a"}, &File{Name: "b"}, &File{Name: "c"}
+	tracker := &Tracker{
+		seeder:   seeder,
+		policy:   SeedPolicy{Duration: time.Hour, MaxSeeds: 2},
+		seedUsed: make(map[*File]time.Time),
+		watchers: map[string]*Watcher{"srv": servingWatcher(a, b, c)},
+	}
+
+	tracker.startSeed(a, md)
+	tracker.startSeed(b, md)
+	tracker.startSeed(a, md) // a is now more recent than b.
+	tracker.startSeed(c, md)
+
+	assert.True(t, seeder.Status(a).Running())
+	assert.False(t, seeder.Status(b).Running(), "b was least recently requested")
+	assert.True(t, seeder.Status(c).Running())
+}
+
+func TestTrackerOnlySeedsServedFiles(t *testing.T) {
+	seeder := newFakeSeeder()
+	served, gone := &File{Name: "served"}, &File{Name: "gone"}
+	tracker := &Tracker{
+		seeder:   seeder,
+		policy:   DefaultSeedPolicy,
+		seedUsed: make(map[*File]time.Time),
+		watchers: map[string]*Watcher{"srv": servingWatcher(served, gone)},
+	}
+	tracker.watchers["srv"].purge()
+	tracker.watchers["srv"].Files["served"] = served
+
+	ready := make(chan *File, 2)
+	for _, file := range []*File{served, gone} {
+		file.MetadataInfo = &MetadataInfo{Name: file.Name}
+		ready <- file
+	}
+	close(ready)
+	tracker.SeedEagerly(ready)
+	assert.True(t, seeder.Status(served).Running())
+	assert.False(t, seeder.Status(gone).Running(), "purged files aren't seeded")
+
+	tracker.stopSeeds([]*File{served})
+	assert.NotNil(t, tracker.RemoveWatcher("srv"))
+	tracker.startSeed(served, &Metadata{})
+	assert.False(t, seeder.Status(served).Running(), "nor are files of removed watchers")
+}
@@ -0,0 +1,229 @@
+/*
+ * selector.go
+ *
+ * Strategies for choosing which peers to hand out in announce responses. The tracker parses
+ * announces and keeps track of the swarms; a PeerSelector decides who gets to talk to whom.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peers handed out when the client doesn't say how many it wants, and the most we ever give.
+const (
+	DEFAULT_NUMWANT = 50
+	MAX_NUMWANT     = 100
+)
+
+// Swarm is the state of a swarm, as seen by a PeerSelector.
+type Swarm struct {
+	InfoHash string
+	Peers    []Peer // Every live peer in the swarm other than the one asking.
+}
+
+// PeerSelector picks up to numwant peers from the swarm to give to the requester. It's called
+// for every announce, from many goroutines at once. It may reorder swarm.Peers.
+type PeerSelector interface {
+	SelectPeers(requester *Peer, swarm *Swarm, numwant int) []Peer
+}
+
+// shufflePeers puts peers in a random order.
+func shufflePeers(peers []Peer) {
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+}
+
+// firstPeers returns at most numwant of the peers.
+func firstPeers(peers []Peer, numwant int) []Peer {
+	if len(peers) > numwant {
+		return peers[:numwant]
+	}
+	return peers
+}
+
+// RandomSelector hands out a random selection of the swarm. This is the default.
+type RandomSelector struct{}
+
+func (self RandomSelector) SelectPeers(requester *Peer, swarm *Swarm, numwant int) []Peer {
+	shufflePeers(swarm.Peers)
+	return firstPeers(swarm.Peers, numwant)
+}
+
+// TopologySelector hands out the peers closest to the requester, see Topology.SelectPeers.
+// While a swarm has no seeder in a datacenter, up to RemoteFetchers of the hosts there get
+// RemoteFraction (rounded up) of their peers from other datacenters; the rest only get
+// local peers, so just a few copies cross the WAN and the datacenter shares them.
+type TopologySelector struct {
+	Topology       *Topology
+	RemoteFraction float64
+	RemoteFetchers int
+
+	lock     sync.Mutex
+	fetchers map[string]map[string][]string // By info_hash, then datacenter: peer ids.
+}
+
+// NewTopologySelector makes a TopologySelector, checking the remote fraction is sensible.
+func NewTopologySelector(topology *Topology, remoteFraction float64) (*TopologySelector,
+	error) {
+	if remoteFraction < 0 || remoteFraction > 1 {
+		return nil, errors.New(fmt.Sprintf("remote fraction %f must be between 0 and 1",
+			remoteFraction))
+	}
+	return &TopologySelector{
+		Topology:       topology,
+		RemoteFraction: remoteFraction,
+		RemoteFetchers: REMOTE_FETCHERS,
+		fetchers:       make(map[string]map[string][]string),
+	}, nil
+}
+
+func (self *TopologySelector) SelectPeers(requester *Peer, swarm *Swarm, numwant int) []Peer {
+	remote := 0
+	if self.fetchesRemote(requester, swarm) {
+		remote = int(math.Ceil(float64(numwant) * self.RemoteFraction))
+	}
+	return self.Topology.SelectPeers(requester, swarm.Peers, numwant, remote)
+}
+
+// fetchesRemote says whether requester is one of the hosts in its datacenter that get peers
+// from other datacenters. Nobody does once there's a seeder in the datacenter, and hosts that
+// leave the swarm make room for others.
+func (self *TopologySelector) fetchesRemote(requester *Peer, swarm *Swarm) bool {
+	location, ok := self.Topology.Locate(requester.Ip)
+	if !ok || requester.Left == 0 {
+		return false
+	}
+	inSwarm := map[string]bool{requester.Id: true}
+	for _, peer := range swarm.Peers {
+		inSwarm[peer.Id] = true
+		if other, ok := self.Topology.Locate(peer.Ip); ok && peer.Left == 0 &&
+			other.Datacenter == location.Datacenter {
+			return false
+		}
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.fetchers[swarm.InfoHash] == nil {
+		self.fetchers[swarm.InfoHash] = make(map[string][]string)
+	}
+	var fetchers []string
+	for _, id := range self.fetchers[swarm.InfoHash][location.Datacenter] {
+		if id == requester.Id {
+			return true
+		}
+		if inSwarm[id] {
+			fetchers = append(fetchers, id)
+		}
+	}
+	fetching := len(fetchers) < self.RemoteFetchers
+	if fetching {
+		fetchers = append(fetchers, requester.Id)
+	}
+	self.fetchers[swarm.InfoHash][location.Datacenter] = fetchers
+	return fetching
+}
+
+// Forget drops what we remember about a swarm, when it goes away.
+func (self *TopologySelector) Forget(info_hash string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	delete(self.fetchers, info_hash)
+}
+
+// SeederSelector hands leechers the seeders first, since they have everything, and seeders
+// the leechers first, since other seeders have nothing they need.
+type SeederSelector struct{}
+
+func (self SeederSelector) SelectPeers(requester *Peer, swarm *Swarm, numwant int) []Peer {
+	shufflePeers(swarm.Peers)
+	wantSeeders := requester.Left != 0
+	sort.SliceStable(swarm.Peers, func(i, j int) bool {
+		iSeeder, jSeeder := swarm.Peers[i].Left == 0, swarm.Peers[j].Left == 0
+		return iSeeder != jSeeder && iSeeder == wantSeeders
+	})
+	return firstPeers(swarm.Peers, numwant)
+}
+
+// LeastRecentSelector hands out the peers that were handed out longest ago (or never), which
+// spreads the load evenly across the swarm instead of leaving it to chance.
+type LeastRecentSelector struct {
+	lock    sync.Mutex
+	handout map[string]map[string]time.Time // By info_hash, then peer id.
+}
+
+func NewLeastRecentSelector() *LeastRecentSelector {
+	return &LeastRecentSelector{
+		handout: make(map[string]map[string]time.Time),
+	}
+}
+
+func (self *LeastRecentSelector) SelectPeers(requester *Peer, swarm *Swarm,
+	numwant int) []Peer {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// Only remember the peers that are still around, so this doesn't grow forever.
+	last := self.handout[swarm.InfoHash]
+	current := make(map[string]time.Time, len(swarm.Peers))
+	for _, peer := range swarm.Peers {
+		current[peer.Id] = last[peer.Id]
+	}
+	if when, ok := last[requester.Id]; ok {
+		current[requester.Id] = when
+	}
+	self.handout[swarm.InfoHash] = current
+
+	// Ties (most commonly, peers never handed out) are broken randomly.
+	shufflePeers(swarm.Peers)
+	sort.SliceStable(swarm.Peers, func(i, j int) bool {
+		return current[swarm.Peers[i].Id].Before(current[swarm.Peers[j].Id])
+	})
+	peers := firstPeers(swarm.Peers, numwant)
+	now := time.Now()
+	for _, peer := range peers {
+		current[peer.Id] = now
+	}
+	return peers
+}
+
+// Forget drops what we remember about a swarm, when it goes away.
+func (self *LeastRecentSelector) Forget(info_hash string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	delete(self.handout, info_hash)
+}
+
+// NewPeerSelector returns one of the built-in selectors by name: random, topology, seeders or
+// least-recent. The topology selector needs a topology.
+func NewPeerSelector(name string, topology *Topology, remoteFraction float64) (PeerSelector,
+	error) {
+	switch name {
+	case "random":
+		return RandomSelector{}, nil
+	case "topology":
+		if topology == nil {
+			return nil, errors.New("the topology selector needs a topology")
+		}
+		return NewTopologySelector(topology, remoteFraction)
+	case "seeders":
+		return SeederSelector{}, nil
+	case "least-recent":
+		return NewLeastRecentSelector(), nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown peer selector %q", name))
+}
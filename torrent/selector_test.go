@@ -0,0 +1,84 @@
+package torrent
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeSwarm(seeders, leechers int) *Swarm {
+	swarm := &Swarm{InfoHash: "hash"}
+	for i := 0; i < seeders+leechers; i++ {
+		peer := Peer{Id: fmt.Sprintf("peer%d", i), Ip: fmt.Sprintf("10.0.0.%d", i)}
+		if i >= seeders {
+			peer.Left = 100
+		}
+		swarm.Peers = append(swarm.Peers, peer)
+	}
+	return swarm
+}
+
+func TestRandomSelector(t *testing.T) {
+	assert.Len(t, RandomSelector{}.SelectPeers(&Peer{}, makeSwarm(5, 5), 3), 3)
+	assert.Len(t, RandomSelector{}.SelectPeers(&Peer{}, makeSwarm(1, 1), 3), 2)
+}
+
+func TestSeederSelector(t *testing.T) {
+	peers := SeederSelector{}.SelectPeers(&Peer{Left: 10}, makeSwarm(3, 10), 5)
+	assert.Len(t, peers, 5)
+	for i, peer := range peers {
+		assert.Equal(t, i >= 3, peer.Left != 0, "leechers get the seeders first")
+	}
+
+	peers = SeederSelector{}.SelectPeers(&Peer{Left: 0}, makeSwarm(10, 3), 5)
+	for i, peer := range peers {
+		assert.Equal(t, i < 3, peer.Left != 0, "seeders get the leechers first")
+	}
+}
+
+func TestLeastRecentSelector(t *testing.T) {
+	selector := NewLeastRecentSelector()
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		for _, peer := range selector.SelectPeers(&Peer{Id: "me"}, makeSwarm(0, 10), 5) {
+			seen[peer.Id]++
+		}
+	}
+	// 20 handouts over 10 peers: everyone twice, no matter the shuffling.
+	assert.Len(t, seen, 10)
+	for id, count := range seen {
+		assert.Equal(t, 2, count, id)
+	}
+
+	// Peers that leave are forgotten.
+	selector.SelectPeers(&Peer{Id: "me"}, makeSwarm(0, 2), 4)
+	assert.Len(t, selector.handout["hash"], 2)
+	selector.Forget("hash")
+	assert.Empty(t, selector.handout)
+}
+
+func TestNewPeerSelector(t *testing.T) {
+	for _, name := range []string{"random", "seeders", "least-recent"} {
+		selector, err := NewPeerSelector(name, nil, 0)
+		assert.Nil(t, err)
+		assert.NotNil(t, selector)
+	}
+	_, err := NewPeerSelector("topology", nil, 0.1)
+	assert.NotNil(t, err, "needs a topology")
+	_, err = NewPeerSelector("topology", &Topology{}, 2)
+	assert.NotNil(t, err, "bad fraction")
+	_, err = NewPeerSelector("nearest", nil, 0)
+	assert.NotNil(t, err)
+}
+
+func TestTrackerNumWant(t *testing.T) {
+	tracker := newTestTracker()
+	assert.Equal(t, DEFAULT_NUMWANT, tracker.numwant(-1))
+	assert.Equal(t, 0, tracker.numwant(0))
+	assert.Equal(t, MAX_NUMWANT, tracker.numwant(1000))
+
+	tracker.options = TrackerOptions{DefaultNumWant: 10, MaxNumWant: 20}
+	assert.Equal(t, 10, tracker.numwant(-1))
+	assert.Equal(t, 20, tracker.numwant(30))
+}
@@ -0,0 +1,166 @@
+/*
+ * state.go
+ *
+ * Saves the tracker's swarms to disk every so often and when it's closed, and loads them back
+ * when it starts, so restarting the distributor doesn't leave every swarm empty until clients
+ * announce again minutes later.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How often the swarms are saved, by default.
+const SAVE_INTERVAL = 1 * time.Minute
+
+// Bumped whenever trackerState changes incompatibly; older state files are ignored.
+const STATE_VERSION = 1
+
+// trackerState is what's saved: the tracker's swarms, gob encoded (peer IDs and info_hashes
+// are binary, so JSON won't do).
+type trackerState struct {
+	Version   int
+	Saved     time.Time
+	PeerList  map[string]map[string]Peer
+	PeerSeen  map[string]map[string]time.Time
+	Completed map[string]int
+}
+
+// startSaver starts the goroutine that saves our swarms to the state file until the tracker
+// is closed, and once more then. Does nothing if there's no state file.
+func (self *Tracker) startSaver() {
+	if self.options.StateFile == "" {
+		return
+	}
+	interval := self.options.SaveInterval
+	if interval <= 0 {
+		interval = SAVE_INTERVAL
+	}
+	self.saverDone = make(chan bool)
+
+	go func() {
+		defer close(self.saverDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-self.quitChan:
+				if err := self.saveState(self.options.StateFile); err != nil {
+					LogError("Failed to save tracker state: %s", err)
+				}
+				return
+			}
+			if err := self.saveState(self.options.StateFile); err != nil {
+				LogError("Failed to save tracker state: %s", err)
+			}
+		}
+	}()
+}
+
+// encodeState returns our swarms, encoded. They're also sent to members of our cluster that
+// are starting up.
+func (self *Tracker) encodeState() ([]byte, error) {
+	self.peerListLock.Lock()
+	defer self.peerListLock.Unlock()
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(trackerState{
+		Version:   STATE_VERSION,
+		Saved:     time.Now(),
+		PeerList:  self.PeerList,
+		PeerSeen:  self.PeerSeen,
+		Completed: self.Completed,
+	})
+	return buf.Bytes(), err
+}
+
+// saveState writes our swarms to path. The file is replaced atomically, so a crash while
+// saving leaves the previous one in place.
+func (self *Tracker) saveState(path string) error {
+	data, err := self.encodeState()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once it's been renamed.
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadState reads the swarms saved in path, see mergeState.
+func (self *Tracker) loadState(path string, now time.Time) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return self.mergeState(data, now)
+}
+
+// mergeState adds the swarms in an encoded state to ours, keeping the peers that announced
+// within peerTTL of now. Where we already know a peer, the most recent announce wins. Returns
+// how many peers were added or updated.
+func (self *Tracker) mergeState(data []byte, now time.Time) (int, error) {
+	var state trackerState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return 0, err
+	}
+	if state.Version != STATE_VERSION {
+		return 0, errors.New(fmt.Sprintf("state version %d, expected %d", state.Version,
+			STATE_VERSION))
+	}
+
+	self.peerListLock.Lock()
+	defer self.peerListLock.Unlock()
+
+	loaded := 0
+	for info_hash, peerseen := range state.PeerSeen {
+		for id, seen := range peerseen {
+			peer, ok := state.PeerList[info_hash][id]
+			if !ok || now.Sub(seen) > self.peerTTL() {
+				continue
+			}
+			if last, ok := self.PeerSeen[info_hash][id]; ok && !seen.After(last) {
+				continue
+			}
+			if self.PeerList[info_hash] == nil {
+				self.PeerList[info_hash] = make(map[string]Peer)
+			}
+			if self.PeerSeen[info_hash] == nil {
+				self.PeerSeen[info_hash] = make(map[string]time.Time)
+			}
+			if state.Completed[info_hash] > self.Completed[info_hash] {
+				self.Completed[info_hash] = state.Completed[info_hash]
+			}
+			self.PeerList[info_hash][id] = peer
+			self.PeerSeen[info_hash][id] = seen
+			loaded++
+		}
+	}
+	return loaded, nil
+}
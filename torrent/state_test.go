@@ -0,0 +1,75 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveAndLoadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	tracker := newTestTracker()
+	tracker.options = TrackerOptions{PeerTTL: time.Minute}
+	hash, stale := strings.Repeat("h", 20), strings.Repeat("s", 20)
+	announce(t, tracker, "10.0.0.1:5000", url.Values{"peer_id": {"\x00\xff binary"},
+		"port": {"1"}, "info_hash": {hash}, "left": {"0"}, "event": {"completed"}})
+	announce(t, tracker, "10.0.0.2:5000", url.Values{"peer_id": {"old"}, "port": {"1"},
+		"info_hash": {hash}})
+	announce(t, tracker, "10.0.0.3:5000", url.Values{"peer_id": {"gone"}, "port": {"1"},
+		"info_hash": {stale}})
+	tracker.PeerSeen[hash]["old"] = time.Now().Add(-2 * time.Minute)
+	tracker.PeerSeen[stale]["gone"] = time.Now().Add(-2 * time.Minute)
+	assert.Nil(t, tracker.saveState(path))
+
+	restarted := newTestTracker()
+	restarted.options = tracker.options
+	loaded, err := restarted.loadState(path, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, loaded, "peers past their TTL aren't loaded")
+	assert.Equal(t, tracker.PeerList[hash]["\x00\xff binary"],
+		restarted.PeerList[hash]["\x00\xff binary"])
+	assert.NotContains(t, restarted.PeerList[hash], "old")
+	assert.NotContains(t, restarted.PeerList, stale, "swarms with no live peers are dropped")
+	assert.Equal(t, map[string]int{hash: 1}, restarted.Completed)
+
+	// The loaded peers are handed out.
+	response := announce(t, restarted, "10.0.0.9:5000", url.Values{"peer_id": {"new"},
+		"port": {"1"}, "info_hash": {hash}})
+	assert.Len(t, response["peers"], 1)
+
+	_, err = restarted.loadState(filepath.Join(dir, "missing"), time.Now())
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, ioutil.WriteFile(path, []byte("garbage"), 0644))
+	_, err = restarted.loadState(path, time.Now())
+	assert.NotNil(t, err)
+}
+
+func TestSaveStateOnClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	tracker := newTestTracker()
+	tracker.options = TrackerOptions{StateFile: path, SaveInterval: time.Hour}
+	tracker.startSaver()
+	announce(t, tracker, "10.0.0.1:5000", url.Values{"peer_id": {"a"}, "port": {"1"}})
+	tracker.Close()
+
+	restarted := newTestTracker()
+	loaded, err := restarted.loadState(path, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, loaded)
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "no temporary files left behind")
+}
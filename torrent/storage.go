@@ -0,0 +1,125 @@
+/*
+ * storage.go
+ *
+ * Random access to the data described by a torrent. For a multi-file torrent, the files are
+ * treated as one long stream in the order they appear in the metadata, as the spec requires.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// storage is an io.ReaderAt over all the files of a torrent. Padding files read as zeros.
+type storage struct {
+	files   []*os.File // nil for padding.
+	offsets []int64    // Offset of the start of each file within the stream.
+	lengths []int64
+	size    int64
+}
+
+// openStorage opens the data for a torrent. For a single-file torrent fqfn is the file; for a
+// multi-file torrent it is the directory the paths in the metadata are relative to.
+func openStorage(fqfn string, info *MetadataInfo) (*storage, error) {
+	stat, err := os.Stat(fqfn)
+	if err != nil {
+		return nil, err
+	}
+
+	self := &storage{}
+	layout := info.pieceLayout()
+	if !stat.IsDir() {
+		file, err := os.Open(fqfn)
+		if err != nil {
+			return nil, err
+		}
+		self.add(file, layout[0].Length)
+		return self, nil
+	}
+
+	for _, mdfile := range layout {
+		if mdfile.isPadding() {
+			self.add(nil, mdfile.Length)
+			continue
+		}
+		file, err := os.Open(filepath.Join(fqfn, filepath.Join(mdfile.Path...)))
+		if err != nil {
+			self.Close()
+			return nil, err
+		}
+		self.add(file, mdfile.Length)
+	}
+	return self, nil
+}
+
+func (self *storage) add(file *os.File, length int64) {
+	self.files = append(self.files, file)
+	self.offsets = append(self.offsets, self.size)
+	self.lengths = append(self.lengths, length)
+	self.size += length
+}
+
+// ReadAt reads from the stream, crossing file boundaries as needed.
+func (self *storage) ReadAt(buf []byte, off int64) (int, error) {
+	if off >= self.size {
+		return 0, io.EOF
+	}
+
+	// Find the last file starting at or before off. Zero-length files are skipped naturally
+	// since the next file has the same offset.
+	idx := sort.Search(len(self.offsets), func(i int) bool {
+		return self.offsets[i] > off
+	}) - 1
+
+	read := 0
+	for read < len(buf) && idx < len(self.files) {
+		fileOff := off + int64(read) - self.offsets[idx]
+		want := int64(len(buf) - read)
+		if left := self.lengths[idx] - fileOff; want > left {
+			want = left
+		}
+		if want > 0 && self.files[idx] == nil {
+			for i := read; i < read+int(want); i++ {
+				buf[i] = 0
+			}
+			read += int(want)
+		} else if want > 0 {
+			n, err := self.files[idx].ReadAt(buf[read:read+int(want)], fileOff)
+			read += n
+			if err != nil && !(err == io.EOF && int64(n) == want) {
+				if err == io.EOF {
+					// The file is shorter than the metadata says; it changed underneath us.
+					err = io.ErrUnexpectedEOF
+				}
+				return read, err
+			}
+		}
+		idx++
+	}
+	if read < len(buf) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// Close closes all of the underlying files.
+func (self *storage) Close() error {
+	var firstErr error
+	for _, file := range self.files {
+		if file == nil {
+			continue
+		}
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,219 @@
+/*
+ * supervisor.go
+ *
+ * Keeps track of seeds: runs them, restarts them when they crash and remembers how each of
+ * them ended so the state can be reported.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"errors"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RestartPolicy controls what happens when a seed crashes. A seed that exits cleanly is never
+// restarted; it gets started again the next time the file is requested.
+type RestartPolicy struct {
+	MaxRestarts int           // Consecutive crashes before giving up; 0 never restarts.
+	MinBackoff  time.Duration // Wait before the first restart. Doubles on each crash.
+	MaxBackoff  time.Duration // Upper bound for the wait between restarts.
+}
+
+// Statuses of seeds that have ended that we keep for reporting. Beyond this, the ones that
+// ended longest ago are forgotten, so files that are replaced or go away don't pile up.
+const SEED_STATUSES = 1000
+
+// DefaultRestartPolicy is used by the seeders unless told otherwise.
+var DefaultRestartPolicy = RestartPolicy{
+	MaxRestarts: 5,
+	MinBackoff:  1 * time.Second,
+	MaxBackoff:  5 * time.Minute,
+}
+
+// backoff returns how long to wait before the given restart (starting at 1).
+func (self RestartPolicy) backoff(restart int) time.Duration {
+	wait := self.MinBackoff
+	for i := 1; i < restart && wait < self.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > self.MaxBackoff {
+		wait = self.MaxBackoff
+	}
+	return wait
+}
+
+// seedRunner runs one seed for a file until it exits on its own or stop is closed. A non-nil
+// error means the seed crashed.
+type seedRunner func(stop chan bool) error
+
+// supervisedSeed is the bookkeeping for a single file's seed.
+type supervisedSeed struct {
+	status SeedStatus
+	active bool      // True from start until the supervising goroutine is done.
+	ended  time.Time // When it stopped being active.
+	stop   chan bool
+	done   chan bool
+}
+
+// supervisor runs seeds for the seeders in this package. Statuses are kept for files after
+// their seed has exited, so we can report how it went, up to keep of them.
+type supervisor struct {
+	lock  sync.Mutex
+	seeds map[*File]*supervisedSeed
+	keep  int
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{
+		seeds: make(map[*File]*supervisedSeed),
+		keep:  SEED_STATUSES,
+	}
+}
+
+// start runs a seed for the file under the given policy, unless one is already active.
+func (self *supervisor) start(file *File, policy RestartPolicy, run seedRunner) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if seed := self.seeds[file]; seed != nil && seed.active {
+		return
+	}
+	seed := &supervisedSeed{
+		status: SeedStatus{State: SeedRunning, Started: time.Now()},
+		active: true,
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+	self.seeds[file] = seed
+	self.forgetEnded()
+	go self.supervise(file, seed, policy, run)
+}
+
+// forgetEnded drops the statuses of the seeds that ended longest ago, beyond the ones we keep.
+// Must be called with lock held.
+func (self *supervisor) forgetEnded() {
+	var ended []*File
+	for file, seed := range self.seeds {
+		if !seed.active {
+			ended = append(ended, file)
+		}
+	}
+	if len(ended) <= self.keep {
+		return
+	}
+	sort.Slice(ended, func(i, j int) bool {
+		return self.seeds[ended[i]].ended.Before(self.seeds[ended[j]].ended)
+	})
+	for _, file := range ended[:len(ended)-self.keep] {
+		delete(self.seeds, file)
+	}
+}
+
+// end marks a seed as no longer active. Must be called with lock held.
+func (self *supervisedSeed) end() {
+	self.active = false
+	self.ended = time.Now()
+}
+
+// supervise is the goroutine that owns a single seed, running and restarting it as needed.
+func (self *supervisor) supervise(file *File, seed *supervisedSeed, policy RestartPolicy,
+	run seedRunner) {
+	defer close(seed.done)
+
+	for restarts := 0; ; {
+		self.lock.Lock()
+		seed.status.State = SeedRunning
+		seed.status.Started = time.Now()
+		seed.status.Restarts = restarts
+		self.lock.Unlock()
+
+		LogDebug("Seed starting: %s", file.Name)
+		err := run(seed.stop)
+
+		stopped := false
+		select {
+		case <-seed.stop:
+			stopped = true
+		default:
+		}
+
+		self.lock.Lock()
+		seed.status.Runtime = time.Since(seed.status.Started)
+		seed.status.ExitCode = 0
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			seed.status.ExitCode = exitErr.ExitCode()
+		}
+		if err == nil || stopped {
+			// Clean exits (and the ones we asked for) just wait for the next request.
+			LogDebug("Seed exited: %s", file.Name)
+			seed.status.State = SeedExited
+			seed.end()
+			self.lock.Unlock()
+			return
+		}
+
+		restarts++
+		seed.status.State = SeedFailed
+		seed.status.LastError = err.Error()
+		if restarts > policy.MaxRestarts {
+			LogError("Seed for %s failed, giving up: %s", file.Name, err)
+			seed.end()
+			self.lock.Unlock()
+			return
+		}
+		self.lock.Unlock()
+
+		wait := policy.backoff(restarts)
+		LogError("Seed for %s failed, restarting in %s: %s", file.Name, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-seed.stop:
+			self.lock.Lock()
+			seed.end()
+			self.lock.Unlock()
+			return
+		}
+	}
+}
+
+// stop ends the seed for a file, if any, and waits for it to exit.
+func (self *supervisor) stop(file *File) {
+	self.lock.Lock()
+	seed := self.seeds[file]
+	if seed == nil || !seed.active {
+		self.lock.Unlock()
+		return
+	}
+	select {
+	case <-seed.stop:
+	default:
+		close(seed.stop)
+	}
+	self.lock.Unlock()
+
+	<-seed.done
+}
+
+// status returns the current state of a file's seed.
+func (self *supervisor) status(file *File) SeedStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if seed := self.seeds[file]; seed != nil {
+		status := seed.status
+		if status.State == SeedRunning {
+			status.Runtime = time.Since(status.Started)
+		}
+		return status
+	}
+	return SeedStatus{State: SeedIdle}
+}
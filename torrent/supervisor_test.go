@@ -0,0 +1,94 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	policy := RestartPolicy{MaxRestarts: 10, MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, policy.backoff(1))
+	assert.Equal(t, 2*time.Second, policy.backoff(2))
+	assert.Equal(t, 4*time.Second, policy.backoff(3))
+	assert.Equal(t, 5*time.Second, policy.backoff(4), "should be capped")
+	assert.Equal(t, 5*time.Second, policy.backoff(100), "should be capped")
+}
+
+// waitForState polls the seeder until the file's seed is in the given state.
+func waitForState(seeder Seeder, file *File, state SeedState, restarts int) SeedStatus {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status := seeder.Status(file)
+		if (status.State == state && status.Restarts == restarts) || time.Now().After(deadline) {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCommandSeederRestartsCrashes(t *testing.T) {
+	seeder := NewCommandSeeder(func(file *File, torrentPath string, options SeedOptions) []string {
+		return []string{"/bin/sh", "-c", "echo starting; echo boom >&2; exit 3"}
+	})
+	seeder.Restart = RestartPolicy{
+		MaxRestarts: 2,
+		MinBackoff:  time.Millisecond,
+		MaxBackoff:  10 * time.Millisecond,
+	}
+	file := &File{Name: "test", FQFN: "/nonexistent/test"}
+	assert.Equal(t, SeedIdle, seeder.Status(file).State)
+
+	assert.Nil(t, seeder.Start(file, &Metadata{Info: MetadataInfo{Name: "test"}}))
+	status := waitForState(seeder, file, SeedFailed, 2)
+	assert.Equal(t, SeedFailed, status.State)
+	assert.Equal(t, 2, status.Restarts)
+	assert.Equal(t, 3, status.ExitCode)
+	assert.Contains(t, status.LastError, "boom")
+}
+
+func TestCommandSeederCleanExit(t *testing.T) {
+	seeder := NewCommandSeeder(func(file *File, torrentPath string, options SeedOptions) []string {
+		return []string{"/bin/sh", "-c", "exit 0"}
+	})
+	file := &File{Name: "test", FQFN: "/nonexistent/test"}
+
+	assert.Nil(t, seeder.Start(file, &Metadata{Info: MetadataInfo{Name: "test"}}))
+	status := waitForState(seeder, file, SeedExited, 0)
+	assert.Equal(t, SeedExited, status.State)
+	assert.Equal(t, 0, status.ExitCode)
+	assert.Empty(t, status.LastError)
+}
+
+func TestCommandSeederStop(t *testing.T) {
+	seeder := NewCommandSeeder(func(file *File, torrentPath string, options SeedOptions) []string {
+		return []string{"/bin/sh", "-c", "exec sleep 60"}
+	})
+	file := &File{Name: "test", FQFN: "/nonexistent/test"}
+
+	assert.Nil(t, seeder.Start(file, &Metadata{Info: MetadataInfo{Name: "test"}}))
+	assert.True(t, waitForState(seeder, file, SeedRunning, 0).Running())
+	assert.Nil(t, seeder.Stop(file))
+	assert.Equal(t, SeedExited, seeder.Status(file).State, "stopping is not a failure")
+}
+
+func TestSupervisorForgetsOldStatuses(t *testing.T) {
+	supervisor := newSupervisor()
+	supervisor.keep = 2
+	exit := func(stop chan bool) error { return nil }
+	files := []*File{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+	for _, file := range files[:3] {
+		supervisor.start(file, DefaultRestartPolicy, exit)
+		<-supervisor.seeds[file].done
+	}
+	assert.Equal(t, SeedExited, supervisor.status(files[0]).State)
+
+	// Starting another seed forgets the one that ended first.
+	supervisor.start(files[3], DefaultRestartPolicy, exit)
+	assert.Equal(t, SeedIdle, supervisor.status(files[0]).State)
+	assert.Equal(t, SeedExited, supervisor.status(files[1]).State)
+	assert.Equal(t, SeedExited, supervisor.status(files[2]).State)
+	<-supervisor.seeds[files[3]].done
+	assert.Equal(t, SeedExited, supervisor.status(files[3]).State)
+}
@@ -0,0 +1,176 @@
+/*
+ * topology.go
+ *
+ * Knows where peers are in the network, so the tracker can hand out peers that are close to
+ * each other. Locations come from a table file mapping CIDR blocks to a datacenter, row and
+ * rack, one block per line:
+ *
+ *     # CIDR          datacenter  row   rack
+ *     10.1.0.0/16     sjc
+ *     10.1.2.0/24     sjc         r01   rack12
+ *     2001:db8::/48   lhr         r03
+ *
+ * The most specific block containing an address wins. Row and rack are optional.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Fraction of the peers handed out to a datacenter's remote fetchers (see TopologySelector)
+// that are in other datacenters, by default.
+const DEFAULT_REMOTE_FRACTION = 0.1
+
+// Hosts in each datacenter that are handed peers in other datacenters for a swarm, by default,
+// while there's no seeder in the datacenter. Everyone else gets the data from them.
+const REMOTE_FETCHERS = 2
+
+// Location is where a host is.
+type Location struct {
+	Datacenter string
+	Row        string
+	Rack       string
+}
+
+// Distances between two locations, closest first.
+const (
+	distanceRack = iota
+	distanceRow
+	distanceDatacenter
+	distanceRemote
+	distanceCount
+)
+
+// distance returns how far apart two known locations are.
+func (self Location) distance(other Location) int {
+	if self.Datacenter == "" || self.Datacenter != other.Datacenter {
+		return distanceRemote
+	}
+	if self.Row == "" || self.Row != other.Row {
+		return distanceDatacenter
+	}
+	if self.Rack == "" || self.Rack != other.Rack {
+		return distanceRow
+	}
+	return distanceRack
+}
+
+type topologyEntry struct {
+	network  *net.IPNet
+	location Location
+}
+
+// Topology maps IP addresses to locations.
+type Topology struct {
+	entries []topologyEntry // Most specific first.
+}
+
+// LoadTopology reads a topology table file.
+func LoadTopology(path string) (*Topology, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	self := &Topology{}
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 4 {
+			return nil, errors.New(fmt.Sprintf("%s:%d: expected CIDR datacenter [row [rack]]",
+				path, lineno))
+		}
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s:%d: %s", path, lineno, err))
+		}
+		fields = append(fields, "", "")
+		self.add(network, Location{Datacenter: fields[1], Row: fields[2], Rack: fields[3]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	LogInfo("Loaded %d topology entries from %s", len(self.entries), path)
+	return self, nil
+}
+
+// add adds a block to the table, keeping the most specific blocks first.
+func (self *Topology) add(network *net.IPNet, location Location) {
+	self.entries = append(self.entries, topologyEntry{network: network, location: location})
+	sort.SliceStable(self.entries, func(i, j int) bool {
+		ones_i, _ := self.entries[i].network.Mask.Size()
+		ones_j, _ := self.entries[j].network.Mask.Size()
+		return ones_i > ones_j
+	})
+}
+
+// Locate returns where an IP address is, if we know.
+func (self *Topology) Locate(ip string) (Location, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return Location{}, false
+	}
+	for _, entry := range self.entries {
+		if entry.network.Contains(parsed) {
+			return entry.location, true
+		}
+	}
+	return Location{}, false
+}
+
+// SelectPeers picks up to numwant of the candidates to hand to requester, closest first. Up
+// to remote of them are kept for peers in other datacenters, for the hosts that fetch data
+// from outside. The rest come from the same rack, then row, then datacenter, and if that's
+// still not enough, from other datacenters after all. Peers we can't locate count as remote.
+func (self *Topology) SelectPeers(requester *Peer, candidates []Peer, numwant int,
+	remote int) []Peer {
+	var tiers [distanceCount][]Peer
+	location, known := self.Locate(requester.Ip)
+	for _, candidate := range candidates {
+		distance := distanceRemote
+		if other, ok := self.Locate(candidate.Ip); known && ok {
+			distance = location.distance(other)
+		}
+		tiers[distance] = append(tiers[distance], candidate)
+	}
+	for _, tier := range tiers {
+		rand.Shuffle(len(tier), func(i, j int) { tier[i], tier[j] = tier[j], tier[i] })
+	}
+
+	take := func(out []Peer, tier *[]Peer, count int) []Peer {
+		if count > len(*tier) {
+			count = len(*tier)
+		}
+		out = append(out, (*tier)[:count]...)
+		*tier = (*tier)[count:]
+		return out
+	}
+
+	out := make([]Peer, 0, numwant)
+	out = take(out, &tiers[distanceRemote], remote)
+	for distance := range tiers {
+		out = take(out, &tiers[distance], numwant-len(out))
+	}
+	return out
+}
@@ -0,0 +1,155 @@
+package torrent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTopology(t *testing.T, contents string) (*Topology, error) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "topology")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	return LoadTopology(path)
+}
+
+func TestLoadTopology(t *testing.T) {
+	topology, err := writeTopology(t, `
+# Comments and blank lines are fine.
+10.0.0.0/8       sjc
+10.1.2.0/24      sjc r01 rack12  # The most specific block wins.
+10.1.0.0/16      sjc r01
+2001:db8::/48    lhr r03
+`)
+	assert.Nil(t, err)
+
+	location, ok := topology.Locate("10.1.2.3")
+	assert.True(t, ok)
+	assert.Equal(t, Location{"sjc", "r01", "rack12"}, location)
+	location, _ = topology.Locate("10.1.3.3")
+	assert.Equal(t, Location{"sjc", "r01", ""}, location)
+	location, _ = topology.Locate("10.9.9.9")
+	assert.Equal(t, Location{"sjc", "", ""}, location)
+	location, _ = topology.Locate("2001:db8::1")
+	assert.Equal(t, Location{"lhr", "r03", ""}, location)
+	_, ok = topology.Locate("192.168.0.1")
+	assert.False(t, ok)
+	_, ok = topology.Locate("not-an-ip")
+	assert.False(t, ok)
+
+	_, err = writeTopology(t, "10.0.0.0/8\n")
+	assert.NotNil(t, err, "missing datacenter")
+	_, err = writeTopology(t, "10.0.0.0/33 sjc\n")
+	assert.NotNil(t, err, "bad CIDR")
+}
+
+func TestTopologySelectPeers(t *testing.T) {
+	topology, err := writeTopology(t, `
+10.1.1.0/24  sjc r01 rack1
+10.1.2.0/24  sjc r01 rack2
+10.2.1.0/24  sjc r02 rack1
+10.9.0.0/16  lhr r01 rack1
+`)
+	assert.Nil(t, err)
+
+	var candidates []Peer
+	add := func(prefix string, count int) {
+		for i := 1; i <= count; i++ {
+			candidates = append(candidates, Peer{Ip: fmt.Sprintf("%s.%d", prefix, i), Port: 1})
+		}
+	}
+	add("10.1.1", 3)  // Same rack.
+	add("10.1.2", 3)  // Same row.
+	add("10.2.1", 3)  // Same datacenter.
+	add("10.9.0", 30) // Remote.
+	add("192.168.0", 3)
+
+	// Peers we can't locate count as remote too.
+	requester := &Peer{Ip: "10.1.1.100"}
+	where := func(peer Peer) string {
+		if peer.Ip[:6] == "10.9.0" || peer.Ip[:6] == "192.16" {
+			return "remote"
+		}
+		return peer.Ip[:6]
+	}
+	location := func(peers []Peer) map[string]int {
+		counts := make(map[string]int)
+		for _, peer := range peers {
+			counts[where(peer)]++
+		}
+		return counts
+	}
+
+	peers := topology.SelectPeers(requester, append([]Peer{}, candidates...), 10, 1)
+	assert.Equal(t, map[string]int{"10.1.1": 3, "10.1.2": 3, "10.2.1": 3, "remote": 1},
+		location(peers), "one remote peer, then closest first")
+	assert.Equal(t, "remote", where(peers[0]), "remote peers are picked first")
+
+	peers = topology.SelectPeers(requester, append([]Peer{}, candidates...), 5, 1)
+	assert.Equal(t, map[string]int{"10.1.1": 3, "10.1.2": 1, "remote": 1}, location(peers))
+
+	peers = topology.SelectPeers(requester, append([]Peer{}, candidates...), 20, 0)
+	assert.Len(t, peers, 20, "remote peers fill in when there aren't enough local ones")
+	assert.Equal(t, 11, location(peers)["remote"])
+
+	// Unknown requesters get whatever's around.
+	peers = topology.SelectPeers(&Peer{Ip: "172.16.0.1"}, append([]Peer{}, candidates...),
+		10, 1)
+	assert.Len(t, peers, 10)
+}
+
+func TestTopologySelectorRemoteFetchers(t *testing.T) {
+	topology, err := writeTopology(t, `
+10.1.0.0/16  sjc
+10.9.0.0/16  lhr
+`)
+	assert.Nil(t, err)
+	selector, err := NewTopologySelector(topology, 0.1)
+	assert.Nil(t, err)
+
+	// Lots of hosts in sjc downloading from a seeder in lhr.
+	swarm := &Swarm{InfoHash: "hash"}
+	swarm.Peers = append(swarm.Peers, Peer{Id: "seeder", Ip: "10.9.0.1", Port: 1})
+	for i := 0; i < 200; i++ {
+		swarm.Peers = append(swarm.Peers, Peer{Id: fmt.Sprintf("host%d", i),
+			Ip: fmt.Sprintf("10.1.%d.%d", i/250, i%250+1), Port: 1, Left: 100})
+	}
+	fetchingRemote := func() []string {
+		var fetchers []string
+		for _, requester := range swarm.Peers[1:] {
+			others := &Swarm{InfoHash: swarm.InfoHash}
+			for _, peer := range swarm.Peers {
+				if peer.Id != requester.Id {
+					others.Peers = append(others.Peers, peer)
+				}
+			}
+			for _, peer := range selector.SelectPeers(&requester, others, 50) {
+				if peer.Id == "seeder" {
+					fetchers = append(fetchers, requester.Id)
+				}
+			}
+		}
+		return fetchers
+	}
+	assert.Equal(t, []string{"host0", "host1"}, fetchingRemote(),
+		"only the first two hosts to ask get the remote seeder")
+	assert.Equal(t, []string{"host0", "host1"}, fetchingRemote(), "and they keep it")
+
+	// When a fetcher leaves, someone else takes over.
+	swarm.Peers = append(swarm.Peers[:1], swarm.Peers[2:]...)
+	assert.Equal(t, []string{"host1", "host2"}, fetchingRemote())
+
+	// Once there's a seeder in sjc, nobody needs to fetch across the WAN.
+	swarm.Peers[1].Left = 0
+	assert.Empty(t, fetchingRemote())
+
+	selector.Forget("hash")
+	assert.Empty(t, selector.fetchers)
+}
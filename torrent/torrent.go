@@ -13,79 +13,414 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// Bounds for piece lengths, which are always a power of two. v2 torrents need pieces of at
+// least one 16KB block; clients struggle with anything over 16MB.
+const (
+	MIN_PIECE_LENGTH = int64(16 * 1024)
+	MAX_PIECE_LENGTH = int64(16 * 1024 * 1024)
 )
 
-// 256kb is now the pseudo-standard for BT pieces and is reasonable (metadata file is ~1MB
-// for an 8GB file being served).
-const PIECE_LENGTH = int64(256 * 1024)
+// Most pieces we want in a torrent when picking the piece length, which keeps the metadata
+// small (a 500GB file gets 16MB pieces and a ~600KB pieces string instead of ~40MB).
+const TARGET_PIECES = 2000
+
+// PieceLengthFor picks the piece length for size bytes of data: the smallest power of two
+// that gives no more than TARGET_PIECES pieces, so between 1000 and 2000 of them, within
+// MIN_PIECE_LENGTH and MAX_PIECE_LENGTH.
+func PieceLengthFor(size int64) int64 {
+	pieceLength := MIN_PIECE_LENGTH
+	for pieceLength < MAX_PIECE_LENGTH && size > pieceLength*TARGET_PIECES {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// validPieceLength returns whether a piece length can be used in our torrents.
+func validPieceLength(pieceLength int64) bool {
+	return pieceLength >= MIN_PIECE_LENGTH && pieceLength <= MAX_PIECE_LENGTH &&
+		pieceLength&(pieceLength-1) == 0
+}
+
+// TorrentVersion selects which BitTorrent metadata format we generate.
+type TorrentVersion int
+
+const (
+	TorrentV1     = TorrentVersion(1) // Classic SHA1 pieces (BEP 3).
+	TorrentV2     = TorrentVersion(2) // SHA-256 merkle trees only (BEP 52).
+	TorrentHybrid = TorrentVersion(3) // Both, so v1 and v2 clients can share a swarm.
+)
+
+func (self TorrentVersion) hasV1() bool {
+	return self != TorrentV2
+}
+
+func (self TorrentVersion) hasV2() bool {
+	return self == TorrentV2 || self == TorrentHybrid
+}
+
+// Number of files a watcher hashes at once by default.
+const HASH_CONCURRENCY = 2
+
+// MetadataOptions controls how metadata is generated.
+type MetadataOptions struct {
+	Version     TorrentVersion
+	HashWorkers int // Goroutines hashing the pieces of a single file; 0 means one per CPU.
+	Concurrency int // Files a watcher generates metadata for at once; 0 means HASH_CONCURRENCY.
+
+	// Piece length to use; 0 picks one from the size of the torrent, see PieceLengthFor.
+	// DirPieceLengths overrides it for files (and directory torrents) under the given
+	// directories, which are relative to the watched directory. The longest match wins.
+	PieceLength     int64
+	DirPieceLengths map[string]int64
+
+	// Where to keep hash caches. By default they go next to each file; with CacheDir set
+	// they're kept there instead, so the served directory can be read-only.
+	CacheDir string
+
+	// The watched directory, set by the watcher, so caches in CacheDir are kept apart for
+	// each directory we serve.
+	cacheRoot string
+
+	// Progress, if set, is called with the number of bytes hashed as each piece is done. It's
+	// called from several goroutines at once. The watcher sets this for every file.
+	Progress func(bytes int64)
+}
+
+// DefaultMetadataOptions generates the v1 torrents every client understands.
+var DefaultMetadataOptions = MetadataOptions{
+	Version:     TorrentV1,
+	Concurrency: HASH_CONCURRENCY,
+}
+
+// Validate checks that the piece lengths are usable.
+func (self MetadataOptions) Validate() error {
+	if self.PieceLength != 0 && !validPieceLength(self.PieceLength) {
+		return errors.New(fmt.Sprintf("piece length %d must be a power of two from %d to %d",
+			self.PieceLength, MIN_PIECE_LENGTH, MAX_PIECE_LENGTH))
+	}
+	for dir, pieceLength := range self.DirPieceLengths {
+		if !validPieceLength(pieceLength) {
+			return errors.New(fmt.Sprintf(
+				"piece length %d for %s must be a power of two from %d to %d",
+				pieceLength, dir, MIN_PIECE_LENGTH, MAX_PIECE_LENGTH))
+		}
+	}
+	return nil
+}
+
+// forPath returns the options to use for a file or directory, relative to the watched
+// directory, applying any DirPieceLengths override.
+func (self MetadataOptions) forPath(localfn string) MetadataOptions {
+	best := -1
+	for dir, pieceLength := range self.DirPieceLengths {
+		dir = filepath.ToSlash(filepath.Clean(dir))
+		if dir == "." || localfn == dir || strings.HasPrefix(localfn, dir+"/") {
+			if len(dir) > best {
+				best = len(dir)
+				self.PieceLength = pieceLength
+			}
+		}
+	}
+	return self
+}
+
+// pieceLength returns the piece length to use for size bytes of data.
+func (self MetadataOptions) pieceLength(size int64) int64 {
+	if self.PieceLength != 0 {
+		return self.PieceLength
+	}
+	return PieceLengthFor(size)
+}
+
+// passes returns how many times each byte is read when generating metadata.
+func (self MetadataOptions) passes() int64 {
+	if self.Version == TorrentHybrid {
+		return 2
+	}
+	return 1
+}
 
 type Metadata struct {
-	Announce string       `announce` // URL of our tracker.
-	Info     MetadataInfo `info`
+	Announce     string            `announce`                          // URL of our tracker.
+	AnnounceList [][]string        `bencode:"announce-list,omitempty"` // Tiers of URLs (BEP 12).
+	Info         MetadataInfo      `info`
+	PieceLayers  map[string]string `bencode:"piece layers,omitempty"` // v2 only.
+}
+
+// NewMetadata builds the contents of a .torrent file for the given info and tracker URL.
+func NewMetadata(announce string, info *MetadataInfo) Metadata {
+	return Metadata{
+		Announce:    announce,
+		Info:        *info,
+		PieceLayers: info.PieceLayers,
+	}
 }
 
 type MetadataInfo struct {
-	Name        string `name`         // Filename.
-	PieceLength int    `piece length` // Size of pieces.
-	Pieces      string `pieces`       // The actual pieces data.
-	Length      int64  `length`
+	Name        string         `name`                       // Filename, or directory name.
+	PieceLength int            `piece length`               // Size of pieces.
+	Pieces      string         `bencode:"pieces,omitempty"` // The actual pieces data. v1 only.
+	Length      int64          `bencode:"length,omitempty"` // Single-file v1 torrents only.
+	Files       []MetadataFile `bencode:"files,omitempty"`  // Multi-file v1 torrents only.
+
+	// BitTorrent v2 fields. FileTree maps each path component to a nested map; files are
+	// a map with a single "" key holding their FileTreeEntry.
+	MetaVersion int                    `bencode:"meta version,omitempty"`
+	FileTree    map[string]interface{} `bencode:"file tree,omitempty"`
+
+	// Piece layers aren't part of the info dictionary; they go in the top level of the
+	// .torrent (see NewMetadata). Keyed by pieces root.
+	PieceLayers map[string]string `bencode:"-"`
+}
+
+// MetadataFile is one file of a multi-file torrent.
+type MetadataFile struct {
+	Length int64    `length`
+	Path   []string `path`                     // Path components, relative to the torrent's directory.
+	Attr   string   `bencode:"attr,omitempty"` // "p" for padding files (BEP 47).
 }
 
-// makeHashes takes a file, chunks it into pieces, and calculates SHA1 hashes for each of the
-// chunks.
-func makeHashes(data io.Reader, dataSize int64) ([][]byte, int64, error) {
-	hashCount := int(math.Ceil(float64(dataSize) / float64(PIECE_LENGTH)))
-	hashes := make([][]byte, 0, hashCount)
-	buf := make([]byte, PIECE_LENGTH)
-	bytesRead := int64(0)
-	for {
-		bytesToRead := dataSize - bytesRead
+// isPadding returns whether this file is padding that exists only to align the next file.
+func (self *MetadataFile) isPadding() bool {
+	return strings.Contains(self.Attr, "p")
+}
 
-		// There is a case where bytesToRead becomes negative, because the file has grown
-		// while we were reading it. In this case, bail with nothing. The caller will notice
-		// that the file has changed size and check it again.
-		if bytesToRead < 0 {
-			return nil, 0, nil
+// FileTreeEntry describes one file in a v2 file tree.
+type FileTreeEntry struct {
+	Length     int64  `length`
+	PiecesRoot string `bencode:"pieces root,omitempty"` // Absent for empty files.
+}
+
+// addToFileTree adds a file to a v2 file tree.
+func addToFileTree(tree map[string]interface{}, path []string, entry FileTreeEntry) {
+	for _, component := range path {
+		next, ok := tree[component].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			tree[component] = next
 		}
+		tree = next
+	}
+	tree[""] = entry
+}
+
+// walkFileTree calls fn for every file in a v2 file tree, in the order the spec requires (the
+// same order the tree is bencoded in).
+func walkFileTree(tree map[string]interface{}, prefix []string,
+	fn func(path []string, entry FileTreeEntry)) {
+	keys := make([]string, 0, len(tree))
+	for key := range tree {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-		if bytesToRead > PIECE_LENGTH {
-			bytesToRead = PIECE_LENGTH
+	for _, key := range keys {
+		if entry, ok := tree[key].(FileTreeEntry); ok && key == "" {
+			fn(prefix, entry)
+		} else if subtree, ok := tree[key].(map[string]interface{}); ok {
+			path := append(append([]string{}, prefix...), key)
+			walkFileTree(subtree, path, fn)
 		}
-		if bytesToRead == 0 {
-			break
+	}
+}
+
+// pieceLayout returns the files of the torrent in the way pieces are laid over them. For v1
+// and hybrid torrents this is just the files list (with any padding it has). For v2-only
+// torrents every file starts on a piece boundary, so padding is added between them.
+func (self *MetadataInfo) pieceLayout() []MetadataFile {
+	if self.Pieces != "" || self.MetaVersion != 2 {
+		if len(self.Files) == 0 {
+			return []MetadataFile{{Length: self.Length, Path: []string{self.Name}}}
 		}
+		return self.Files
+	}
 
-		n, err := io.ReadAtLeast(data, buf, int(bytesToRead))
-		if n == 0 && err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, 0, errors.New(fmt.Sprintf("Failed to read: %s", err))
+	var layout []MetadataFile
+	pieceLength := int64(self.PieceLength)
+	walkFileTree(self.FileTree, nil, func(path []string, entry FileTreeEntry) {
+		if len(layout) > 0 {
+			last := layout[len(layout)-1]
+			if pad := last.Length % pieceLength; pad != 0 {
+				layout = append(layout, makePadding(pieceLength-pad))
+			}
 		}
+		layout = append(layout, MetadataFile{Length: entry.Length, Path: path})
+	})
+	return layout
+}
+
+// makePadding builds a BEP 47 padding file of the given length.
+func makePadding(length int64) MetadataFile {
+	return MetadataFile{
+		Length: length,
+		Path:   []string{".pad", strconv.FormatInt(length, 10)},
+		Attr:   "p",
+	}
+}
+
+// TotalLength returns the size of all the data in the torrent, including any padding.
+func (self *MetadataInfo) TotalLength() int64 {
+	total := int64(0)
+	for _, file := range self.pieceLayout() {
+		total += file.Length
+	}
+	return total
+}
+
+// NumPieces returns the number of pieces in the torrent.
+func (self *MetadataInfo) NumPieces() int {
+	if self.Pieces != "" {
+		return len(self.Pieces) / 20
+	}
+	pieceLength := int64(self.PieceLength)
+	return int((self.TotalLength() + pieceLength - 1) / pieceLength)
+}
+
+// InfoHash returns the SHA1 hash of the bencoded info dictionary. This is the value peers and
+// trackers use to identify v1 and hybrid torrents.
+func (self *MetadataInfo) InfoHash() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, *self); err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum(buf.Bytes())
+	return hash[:], nil
+}
+
+// InfoHashV2 returns the SHA-256 hash of the bencoded info dictionary, which identifies v2
+// and hybrid torrents. Trackers and the peer handshake use it truncated to 20 bytes.
+func (self *MetadataInfo) InfoHashV2() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, *self); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(buf.Bytes())
+	return hash[:], nil
+}
 
-		hash := sha1.New()
-		nw, err := hash.Write(buf[:n])
+// SwarmHashes returns the 20-byte hashes peers may use to find this torrent: the v1 info_hash
+// and/or the truncated v2 info_hash.
+func (self *MetadataInfo) SwarmHashes() ([][]byte, error) {
+	var hashes [][]byte
+	if self.Pieces != "" {
+		hash, err := self.InfoHash()
 		if err != nil {
-			return nil, 0, errors.New(fmt.Sprintf("Failed to hash chunk: %s", err))
-		} else if nw != n {
-			return nil, 0, errors.New(fmt.Sprintf("Failed to write to hash; %d != %d", n, nw))
+			return nil, err
 		}
-		hashes = append(hashes, hash.Sum(nil))
-		bytesRead += int64(n)
+		hashes = append(hashes, hash)
+	}
+	if self.MetaVersion == 2 {
+		hash, err := self.InfoHashV2()
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash[:20])
+	}
+	return hashes, nil
+}
+
+// fileV1Hashes returns the SHA1 piece hashes for a file, from the cache if possible.
+func fileV1Hashes(fqfn string, info os.FileInfo, pieceLength int64,
+	options MetadataOptions) ([][]byte, error) {
+	hashCount := int(math.Ceil(float64(info.Size()) / float64(pieceLength)))
+
+	// See if we've already cached this file's hash information.
+	cache_fqfn := options.cacheFile(fqfn, CACHE_SUFFIX_V1)
+	if hashes := readCache(fqfn, info, cache_fqfn, pieceLength, cacheSHA1,
+		hashCount); hashes != nil {
+		return hashes, nil
+	}
+
+	file, err := os.Open(fqfn)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes, err := makeHashesAt(file, info.Size(), pieceLength, options.HashWorkers,
+		options.Progress)
+	if err != nil {
+		LogError("Failed to make hashes for %s: %s", fqfn, err)
+		return nil, err
+	}
+
+	// Write out cache file. Not being able to is no reason to not serve the file.
+	writeCache(cache_fqfn, info, pieceLength, cacheSHA1, hashes)
+	return hashes, nil
+}
+
+// fileV2Hashes returns the piece layer and pieces root for a file, from the cache if possible.
+// Only the piece layer is cached (or the root, for files with no piece layer) since the root
+// is cheap to compute from it.
+func fileV2Hashes(fqfn string, info os.FileInfo, pieceLength int64,
+	options MetadataOptions) ([][]byte, []byte, error) {
+	hashCount := int(math.Ceil(float64(info.Size()) / float64(pieceLength)))
+	cache_fqfn := options.cacheFile(fqfn, CACHE_SUFFIX_V2)
+	if hashes := readCache(fqfn, info, cache_fqfn, pieceLength, cacheSHA256,
+		hashCount); hashes != nil {
+		if hashCount == 1 {
+			return nil, hashes[0], nil
+		}
+		return hashes, rootFromPieceLayer(hashes, pieceLength), nil
+	}
+
+	file, err := os.Open(fqfn)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	layer, root, err := makeV2Hashes(file, info.Size(), pieceLength, options.HashWorkers,
+		options.Progress)
+	if err != nil {
+		LogError("Failed to make v2 hashes for %s: %s", fqfn, err)
+		return nil, nil, err
 	}
 
-	return hashes, bytesRead, nil
+	cached := [][]byte{root}
+	if layer != nil {
+		cached = layer
+	}
+	writeCache(cache_fqfn, info, pieceLength, cacheSHA256, cached)
+	return layer, root, nil
+}
+
+// addV2 fills in the v2 fields of mdinfo for a file.
+func (self *MetadataInfo) addV2(path []string, length int64, layer [][]byte, root []byte) {
+	self.MetaVersion = 2
+	if self.FileTree == nil {
+		self.FileTree = make(map[string]interface{})
+	}
+	entry := FileTreeEntry{Length: length}
+	if length > 0 {
+		entry.PiecesRoot = string(root)
+	}
+	addToFileTree(self.FileTree, path, entry)
+
+	if layer != nil {
+		if self.PieceLayers == nil {
+			self.PieceLayers = make(map[string]string)
+		}
+		self.PieceLayers[string(root)] = string(bytes.Join(layer, []byte{}))
+	}
 }
 
 // GenerateMetadata takes a file and generates the metadata required to serve that file.
-func GenerateMetadataInfo(fqfn string) (*MetadataInfo, error) {
+func GenerateMetadataInfo(fqfn string, options MetadataOptions) (*MetadataInfo, error) {
 	info, err := os.Stat(fqfn)
 	if err != nil {
 		return nil, err
@@ -97,75 +432,144 @@ func GenerateMetadataInfo(fqfn string) (*MetadataInfo, error) {
 		return nil, nil
 	}
 
-	file, err := os.Open(fqfn)
-	if err != nil {
-		return nil, err
+	pieceLength := options.pieceLength(info.Size())
+	mdinfo := &MetadataInfo{
+		Name:        filepath.Base(fqfn),
+		PieceLength: int(pieceLength),
 	}
-	defer file.Close()
 
-	hashCount := int(math.Ceil(float64(info.Size()) / float64(PIECE_LENGTH)))
-	var hashes [][]byte
+	if options.Version.hasV1() {
+		hashes, err := fileV1Hashes(fqfn, info, pieceLength, options)
+		if err != nil {
+			return nil, err
+		}
+		LogDebug("Generated (or cached) metadata for %s:", fqfn)
+		LogDebug(" * Pieces:     %d * %d bytes", len(hashes), pieceLength)
+		LogDebug(" * Hashes:     %d", len(hashes))
+		LogDebug(" * First hash: %s", hex.EncodeToString(hashes[0]))
 
-	// See if we've already cached this file's hash information.
-	use_cache := false
-	cache_bytes := []byte{}
-	cache_fqfn := fqfn + ".mdcache"
-	cache_info, err := os.Stat(cache_fqfn)
-	if err == nil && cache_info != nil {
-		if info.ModTime().After(cache_info.ModTime()) {
-			LogDebug("Cache invalid: %s updated more recently than %s", fqfn, cache_fqfn)
-		} else {
-			cache_bytes, err = ioutil.ReadFile(cache_fqfn)
-			if err == nil {
-				LogDebug("Loaded %d cached bytes from %s.", len(cache_bytes), cache_fqfn)
-				if len(cache_bytes) != hashCount*20 {
-					LogError("Cache invalid: length does not match expected size!")
-				} else {
-					use_cache = true
-				}
-			}
+		mdinfo.Pieces = string(bytes.Join(hashes, []byte{}))
+		mdinfo.Length = info.Size()
+	}
+
+	if options.Version.hasV2() {
+		layer, root, err := fileV2Hashes(fqfn, info, pieceLength, options)
+		if err != nil {
+			return nil, err
 		}
+		LogDebug("Generated (or cached) v2 metadata for %s:", fqfn)
+		LogDebug(" * Piece layer: %d hashes", len(layer))
+		LogDebug(" * Root:        %s", hex.EncodeToString(root))
+
+		mdinfo.addV2([]string{mdinfo.Name}, info.Size(), layer, root)
 	}
+	return mdinfo, nil
+}
 
-	// If we had a cache, break it into the hashes.
-	if use_cache {
-		hashes = make([][]byte, 0, hashCount)
-		for i := 0; i < hashCount; i++ {
-			idx := i * 20
-			hashes = append(hashes, cache_bytes[idx:idx+20])
+// comparePaths orders slash-separated paths component by component, which is the order
+// files appear in a bencoded v2 file tree.
+func comparePaths(a, b string) bool {
+	ac, bc := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(ac) && i < len(bc); i++ {
+		if ac[i] != bc[i] {
+			return ac[i] < bc[i]
 		}
-	} else {
-		var bytesRead int64
-		var err error
-		hashes, bytesRead, err = makeHashes(file, info.Size())
+	}
+	return len(ac) < len(bc)
+}
+
+// GenerateDirMetadataInfo builds the metadata for a multi-file torrent of the given files,
+// which are paths relative to dir. For v1, pieces span file boundaries, so the files are
+// hashed as one stream (hybrid torrents add padding so each file starts on a piece boundary).
+// The files are sorted into the order the spec requires. Nothing is cached, since any file
+// changing invalidates all of the v1 pieces after it.
+func GenerateDirMetadataInfo(dir string, paths []string,
+	options MetadataOptions) (*MetadataInfo, error) {
+	paths = append([]string{}, paths...)
+	for i := range paths {
+		paths[i] = filepath.ToSlash(paths[i])
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return comparePaths(paths[i], paths[j])
+	})
+
+	files := make([]MetadataFile, 0, len(paths))
+	total := int64(0)
+	for _, path := range paths {
+		info, err := os.Stat(filepath.Join(dir, path))
 		if err != nil {
-			LogFatal("Failed to make hashes for file: %s", err)
 			return nil, err
 		}
+		files = append(files, MetadataFile{
+			Length: info.Size(),
+			Path:   strings.Split(path, "/"),
+		})
+		total += info.Size()
+	}
+
+	// As with single files, there's nothing to serve if it's all empty.
+	if total == 0 {
+		return nil, nil
+	}
 
-		// Final sanity check: bytesRead should exactly equal the file size.
-		if int64(bytesRead) != info.Size() {
-			LogFatal("Read %d, size %d... mismatch!", bytesRead, info.Size())
-			// TODO make better message here
-			return nil, errors.New("bytesRead invalid")
+	pieceLength := options.pieceLength(total)
+	mdinfo := &MetadataInfo{
+		Name:        filepath.Base(dir),
+		PieceLength: int(pieceLength),
+	}
+
+	if options.Version.hasV1() {
+		mdinfo.Files = files
+		if options.Version.hasV2() {
+			// Hybrid torrents need every file to start on a piece boundary so the v1 and
+			// v2 pieces line up.
+			mdinfo.Files = make([]MetadataFile, 0, 2*len(files))
+			for i, file := range files {
+				mdinfo.Files = append(mdinfo.Files, file)
+				if pad := file.Length % pieceLength; pad != 0 && i < len(files)-1 {
+					mdinfo.Files = append(mdinfo.Files, makePadding(pieceLength-pad))
+				}
+			}
 		}
+		streamLength := mdinfo.TotalLength()
 
-		// Write out cache file.
-		if err := ioutil.WriteFile(cache_fqfn, bytes.Join(hashes, []byte{}), 0644); err != nil {
-			LogError("Failed to write cache file: %s", err)
+		data, err := openStorage(dir, mdinfo)
+		if err != nil {
 			return nil, err
 		}
+		defer data.Close()
+
+		hashes, err := makeHashesAt(data, streamLength, pieceLength, options.HashWorkers,
+			options.Progress)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to hash %s; files changed? %s",
+				dir, err))
+		}
+		mdinfo.Pieces = string(bytes.Join(hashes, []byte{}))
 	}
-	LogDebug("Generated (or cached) metadata for %s:", fqfn)
-	LogDebug(" * Pieces:     %d * %d bytes", hashCount, PIECE_LENGTH)
-	LogDebug(" * Hashes:     %d", len(hashes))
-	LogDebug(" * First hash: %s", hex.EncodeToString(hashes[0]))
 
-	// Build and return metadata structure, after caching it.
-	return &MetadataInfo{
-		Name:        filepath.Base(fqfn),
-		PieceLength: int(PIECE_LENGTH),
-		Pieces:      string(bytes.Join(hashes, []byte{})),
-		Length:      info.Size(),
-	}, nil
+	if options.Version.hasV2() {
+		for _, file := range files {
+			var layer [][]byte
+			var root []byte
+			if file.Length > 0 {
+				data, err := os.Open(filepath.Join(dir, filepath.Join(file.Path...)))
+				if err != nil {
+					return nil, err
+				}
+				layer, root, err = makeV2Hashes(data, file.Length, pieceLength,
+					options.HashWorkers, options.Progress)
+				data.Close()
+				if err != nil {
+					return nil, err
+				}
+			}
+			mdinfo.addV2(file.Path, file.Length, layer, root)
+		}
+	}
+
+	LogDebug("Generated metadata for directory %s:", dir)
+	LogDebug(" * Files:      %d", len(files))
+	LogDebug(" * Pieces:     %d * %d bytes", mdinfo.NumPieces(), pieceLength)
+	return mdinfo, nil
 }
@@ -1,11 +1,22 @@
 package torrent
 
 import (
+	"bytes"
+	bencode "github.com/jackpal/bencode-go"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
+// The piece length the tests hash with, unless they're testing how it's picked.
+const testPieceLength = int64(256 * 1024)
+
 // Use Python to calculate byte strings for verifying SHA1 hashes:
 //
 // import hashlib; input = "testing";
@@ -14,18 +25,16 @@ import (
 func TestMakeHashesEmptyFile(t *testing.T) {
 	test_file := ""
 	reader := strings.NewReader(test_file)
-	hashes, bytesRead, err := makeHashes(reader, 0)
+	hashes, err := makeHashesAt(reader, 0, testPieceLength, 0, nil)
 	assert.Nil(t, err)
-	assert.Equal(t, bytesRead, int64(0), "should be 0")
 	assert.Empty(t, hashes)
 }
 
 func TestMakeHashesOneChunk(t *testing.T) {
 	test_file := "testing"
 	reader := strings.NewReader(test_file)
-	hashes, bytesRead, err := makeHashes(reader, int64(len(test_file)))
+	hashes, err := makeHashesAt(reader, int64(len(test_file)), testPieceLength, 0, nil)
 	assert.Nil(t, err)
-	assert.Equal(t, bytesRead, int64(len(test_file)), "should match the length of the file")
 	assert.Len(t, hashes, 1, "should have one chunk")
 
 	bytes := []byte{220, 114, 74, 241, 143, 189, 212, 229, 145, 137, 245, 254, 118, 138, 95,
@@ -34,15 +43,14 @@ func TestMakeHashesOneChunk(t *testing.T) {
 }
 
 func TestMakeHashesTwoChunks(t *testing.T) {
-	// Two chunks has to be PIECE_LENGTH*1.5 in length so we don't burble up into three, etc.
+	// Two chunks has to be testPieceLength*1.5 in length so we don't burble up into three, etc.
 	test_file := "testing"
-	test_file = strings.Repeat(test_file, int((float64(PIECE_LENGTH/int64(len(test_file))))*1.5))
+	test_file = strings.Repeat(test_file, int((float64(testPieceLength/int64(len(test_file))))*1.5))
 
 	reader := strings.NewReader(test_file)
-	hashes, bytesRead, err := makeHashes(reader, int64(len(test_file)))
+	hashes, err := makeHashesAt(reader, int64(len(test_file)), testPieceLength, 0, nil)
 	assert.Nil(t, err)
-	assert.Equal(t, bytesRead, int64(len(test_file)), "should match the length of the file")
-	assert.Len(t, hashes, 2, "should have one chunk")
+	assert.Len(t, hashes, 2, "should have two chunks")
 
 	bytes := []byte{247, 218, 76, 179, 188, 125, 55, 53, 207, 46, 38, 44, 239, 5, 213,
 		222, 176, 165, 62, 232}
@@ -52,3 +60,148 @@ func TestMakeHashesTwoChunks(t *testing.T) {
 		175, 183, 114, 183, 201}
 	assert.Equal(t, hashes[1], bytes)
 }
+
+func TestGenerateDirMetadataInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Pieces have to span the boundary between the two files.
+	first := strings.Repeat("a", int(testPieceLength)+100)
+	second := strings.Repeat("b", 500)
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "first"), []byte(first), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "sub", "second"), []byte(second), 0644))
+
+	options := DefaultMetadataOptions
+	options.PieceLength = testPieceLength
+	mdinfo, err := GenerateDirMetadataInfo(dir, []string{"sub/second", "first"}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Base(dir), mdinfo.Name)
+	assert.Equal(t, int64(0), mdinfo.Length)
+	assert.Equal(t, []MetadataFile{
+		{Length: int64(len(first)), Path: []string{"first"}},
+		{Length: int64(len(second)), Path: []string{"sub", "second"}},
+	}, mdinfo.Files)
+	assert.Equal(t, int64(len(first)+len(second)), mdinfo.TotalLength())
+
+	hashes, err := makeHashesAt(strings.NewReader(first+second),
+		int64(len(first)+len(second)), testPieceLength, 0, nil)
+	assert.Nil(t, err)
+	assert.Len(t, hashes, 2)
+	assert.Equal(t, string(bytes.Join(hashes, []byte{})), mdinfo.Pieces)
+}
+
+func TestServeDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, path := range []string{"sub/one", "sub/two"} {
+		assert.Nil(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0755))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, path), []byte(path), 0644))
+	}
+	ready := make(chan *File, 10)
+	watcher := StartWatcher(dir, DefaultMetadataOptions, DefaultWatcherOptions, ready, nil)
+	defer watcher.Close()
+	<-ready
+	<-ready
+
+	tracker := &Tracker{
+		watchers: map[string]*Watcher{"root": watcher},
+		seeder:   newFakeSeeder(),
+		policy:   DefaultSeedPolicy,
+		seedUsed: make(map[*File]time.Time),
+	}
+	w := httptest.NewRecorder()
+	tracker.handleServeDir(w, httptest.NewRequest("GET", "/serve_dir?sub", nil))
+	assert.Equal(t, 200, w.Code)
+	response, err := bencode.Decode(strings.NewReader(w.Body.String()))
+	assert.Nil(t, err)
+	info := response.(map[string]interface{})["info"].(map[string]interface{})
+	assert.Equal(t, "sub", info["name"])
+	assert.Len(t, info["files"], 2)
+
+	w = httptest.NewRecorder()
+	tracker.handleServeDir(w, httptest.NewRequest("GET", "/serve_dir?missing", nil))
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestStorageReadsAcrossFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a"), []byte("abc"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "empty"), []byte{}, 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b"), []byte("defgh"), 0644))
+
+	data, err := openStorage(dir, &MetadataInfo{Files: []MetadataFile{
+		{Length: 3, Path: []string{"a"}},
+		{Length: 0, Path: []string{"empty"}},
+		{Length: 5, Path: []string{"b"}},
+	}})
+	assert.Nil(t, err)
+	defer data.Close()
+
+	buf := make([]byte, 4)
+	n, err := data.ReadAt(buf, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, "bcde", string(buf))
+
+	n, err = data.ReadAt(buf, 6)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "gh", string(buf[:n]))
+}
+
+func TestPieceLengthFor(t *testing.T) {
+	assert.Equal(t, MIN_PIECE_LENGTH, PieceLengthFor(0))
+	assert.Equal(t, MIN_PIECE_LENGTH, PieceLengthFor(MIN_PIECE_LENGTH*TARGET_PIECES))
+	assert.Equal(t, 2*MIN_PIECE_LENGTH, PieceLengthFor(MIN_PIECE_LENGTH*TARGET_PIECES+1))
+	assert.Equal(t, int64(4*1024*1024), PieceLengthFor(5*1024*1024*1024))
+	assert.Equal(t, MAX_PIECE_LENGTH, PieceLengthFor(500*1024*1024*1024))
+	assert.Equal(t, MAX_PIECE_LENGTH, PieceLengthFor(1<<50), "capped")
+}
+
+func TestMetadataOptionsPieceLength(t *testing.T) {
+	options := MetadataOptions{
+		Version:         TorrentV1,
+		DirPieceLengths: map[string]int64{"isos": 1 << 24, "isos/small": 1 << 14},
+	}
+	assert.Nil(t, options.Validate())
+	assert.Equal(t, int64(0), options.forPath("other/file").PieceLength)
+	assert.Equal(t, int64(1<<24), options.forPath("isos/big.iso").PieceLength)
+	assert.Equal(t, int64(1<<24), options.forPath("isos").PieceLength, "directory torrent")
+	assert.Equal(t, int64(1<<14), options.forPath("isos/small/a.iso").PieceLength)
+	assert.Equal(t, int64(0), options.forPath("isosx/file").PieceLength)
+
+	options.PieceLength = 1000
+	assert.NotNil(t, options.Validate(), "not a power of two")
+	options.PieceLength = 1 << 25
+	assert.NotNil(t, options.Validate(), "too big")
+}
+
+func TestCacheRecordsPieceLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fqfn := filepath.Join(dir, "data")
+	assert.Nil(t, ioutil.WriteFile(fqfn, bytes.Repeat([]byte("x"), 100000), 0644))
+
+	small, err := GenerateMetadataInfo(fqfn, MetadataOptions{Version: TorrentV1})
+	assert.Nil(t, err)
+	assert.Equal(t, int(MIN_PIECE_LENGTH), small.PieceLength)
+	assert.Equal(t, 7, small.NumPieces())
+
+	// The cache is for the other piece length, so it mustn't be used.
+	big, err := GenerateMetadataInfo(fqfn,
+		MetadataOptions{Version: TorrentV1, PieceLength: testPieceLength})
+	assert.Nil(t, err)
+	assert.Equal(t, int(testPieceLength), big.PieceLength)
+	assert.Equal(t, 1, big.NumPieces())
+
+	again, err := GenerateMetadataInfo(fqfn, MetadataOptions{Version: TorrentV1})
+	assert.Nil(t, err)
+	assert.Equal(t, small.Pieces, again.Pieces)
+}
@@ -12,15 +12,19 @@
 package torrent
 
 import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -29,49 +33,370 @@ import (
 	bencode "github.com/jackpal/bencode-go"
 )
 
+// How long a peer stays in the swarm without announcing, by default.
+const PEER_TIMEOUT = 600 * time.Second
+
+// How often clients should announce, in seconds: ANNOUNCE_INTERVAL plus up to ANNOUNCE_JITTER,
+// so thousands of hosts started at once don't keep announcing at once. They may announce
+// again after MIN_ANNOUNCE_INTERVAL if they need more peers.
+const (
+	ANNOUNCE_INTERVAL     = 300
+	ANNOUNCE_JITTER       = 120
+	MIN_ANNOUNCE_INTERVAL = 60
+)
+
+// Events clients may send in announces. Some clients send "empty" for a regular announce.
+var announceEvents = map[string]bool{
+	"": true, "empty": true, "started": true, "completed": true, "stopped": true,
+}
+
+// newTrackerId returns a tracker ID that's unique, as cluster members tell themselves apart by
+// them.
+func newTrackerId() string {
+	id := make([]byte, 8)
+	if _, err := cryptorand.Read(id); err != nil {
+		LogFatal("Failed to make a tracker ID: %s", err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// announceInterval returns the interval to give a client.
+func announceInterval() int {
+	return ANNOUNCE_INTERVAL + rand.Intn(ANNOUNCE_JITTER)
+}
+
 type Peer struct {
-	Id   string `peer id`
+	Id   string `bencode:"peer id,omitempty"` // Left out when the client asks for no_peer_id.
 	Ip   string `ip`
 	Port uint16 `port`
+
+	// What the peer last reported. These are for us and aren't sent to other peers.
+	Uploaded   int64 `bencode:"-"`
+	Downloaded int64 `bencode:"-"`
+	Left       int64 `bencode:"-"` // 0 for seeders.
+}
+
+// ScrapeFile is the state of one swarm in a scrape response.
+type ScrapeFile struct {
+	Complete   int `complete`   // Seeders.
+	Incomplete int `incomplete` // Leechers.
+	Downloaded int `downloaded` // Completed downloads we've been told about.
+}
+
+type ScrapeResponse struct {
+	Files map[string]ScrapeFile `files` // Keyed by info_hash.
+}
+
+// FailureResponse is the response to a request we won't or can't serve. Clients show the
+// reason to the user, so it should make sense to them.
+type FailureResponse struct {
+	FailureReason string `bencode:"failure reason"`
 }
 
 type PeerResponse struct {
-	Interval int    `interval`
-	Peers    []Peer `peers`
+	Interval       int    `interval`
+	MinInterval    int    `bencode:"min interval"`
+	TrackerId      string `bencode:"tracker id,omitempty"`
+	WarningMessage string `bencode:"warning message,omitempty"` // Shown to the user.
+	Peers          []Peer `peers`
+}
+
+// CompactPeerResponse is the response for clients that ask for compact=1 (BEP 23). IPv4 peers
+// are 6 bytes each in Peers, and IPv6 ones 18 bytes each in Peers6 (BEP 7).
+type CompactPeerResponse struct {
+	Interval       int    `interval`
+	MinInterval    int    `bencode:"min interval"`
+	TrackerId      string `bencode:"tracker id,omitempty"`
+	WarningMessage string `bencode:"warning message,omitempty"`
+	Peers          string `peers`
+	Peers6         string `bencode:"peers6,omitempty"`
+}
+
+// writeBencoded sends a bencoded response. It's encoded up front so that if that fails, the
+// client gets a failure instead of half a response.
+func writeBencoded(w http.ResponseWriter, response interface{}) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, response); err != nil {
+		LogError("Failed to bencode: %s", err)
+		buf.Reset()
+		bencode.Marshal(&buf, FailureResponse{FailureReason: "internal error"})
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+// writeFailure sends a failure response. Like every other tracker response it's a 200, or
+// clients won't read the reason.
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencoded(w, FailureResponse{FailureReason: reason})
+}
+
+// compactPeers packs peers into the compact IPv4 and IPv6 formats. Peers whose address isn't
+// an IP (the ip parameter may be a DNS name) can't be packed and are left out.
+func compactPeers(peers []Peer) (string, string) {
+	var peers4, peers6 []byte
+	for _, peer := range peers {
+		ip := net.ParseIP(peer.Ip)
+		port := []byte{byte(peer.Port >> 8), byte(peer.Port)}
+		if ip4 := ip.To4(); ip4 != nil {
+			peers4 = append(append(peers4, ip4...), port...)
+		} else if ip != nil {
+			peers6 = append(append(peers6, ip.To16()...), port...)
+		}
+	}
+	return string(peers4), string(peers6)
+}
+
+// normalizeIp returns the canonical form of an IP address, turning IPv4-mapped IPv6
+// addresses into plain IPv4 ones. Anything else (like a DNS name) is returned as is.
+func normalizeIp(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
 }
 
 type Tracker struct {
-	// We keep a separate set of peers for each info_hash. We don't actually verify that these
-	// hashes are valid; so there's a pretty easy DoS here. This system is designed to be used
-	// in a production environment with good actors. TODO: harden.
-	// TODO: We need a way of droppign peers that have not reported in a while.
+	// We keep a separate set of peers for each info_hash. Only the info_hashes of torrents we
+	// serve (and any whitelisted ones) get a swarm, see allowed(); otherwise anyone could
+	// fill our memory with swarms. Peers that stop announcing, and swarms left empty, are
+	// cleaned up by the reaper.
 	PeerSeen     map[string]map[string]time.Time
 	PeerList     map[string]map[string]Peer
+	Completed    map[string]int // Number of completed events for each info_hash.
 	peerListLock sync.Mutex
 
-	// Lock used by all methods that affect the seed process.
-	seedStartLock sync.Mutex
-
 	// The key in the watchers map is how these watchers can be queried for the latest data
-	// see handleServeLastUpdated()
-	//
-	// Careful: there is no locking here. It's assumed that the only time this is
-	// written is from the very initial setup of the app and never during runtime. If that
-	// changes we'll need locking. (This may actually be technically a little racy right
-	// now if there's a ton of requests during power-on, since we start listening
-	// before the watchers are created.)
-	watchers map[string]*Watcher // List of watchers who might have files.
-	ctorrent string              // path to the ctorrent executable.
-}
-
-// findFile searches all of our watchers for a given filename (FQFN). If found, it returns
-// the pointer to the File structure representing this file.
-func (self *Tracker) findFile(name string) *File {
+	// see handleServeLastUpdated(). Watchers come and go at runtime (see AddWatcher), so use
+	// getWatchers() rather than reading the map directly.
+	watchers     map[string]*Watcher // List of watchers who might have files.
+	watchersLock sync.Mutex
+	seeder       Seeder    // Responsible for seeding the files we serve.
+	registry     *Registry // The info_hashes of those files; nil allows any.
+
+	// How we seed, and when each seeding file was last requested so the oldest can be
+	// stopped when we have too many.
+	policy   SeedPolicy
+	seedUsed map[*File]time.Time
+	seedLock sync.Mutex
+
+	// Host and port of our HTTP tracker, used when there's no request to take the Host from,
+	// i.e. eager seeds.
+	httpHost string
+	httpPort int
+
+	// Sent to clients in announce responses, to be sent back in their next announces. We
+	// don't need it, but it tells apart the trackers in a cluster when debugging.
+	trackerId string
+
+	// The UDP tracker, if it's running.
+	options TrackerOptions
+	udp     *udpTracker
+	udpPort int
+
+	// The other distributors we share swarms with, if any.
+	cluster     *cluster
+	clusterDone chan bool
+
+	// For adding endpoints, and shutting down the HTTP server, the reaper and the saver.
+	mux        *http.ServeMux
+	server     *http.Server
+	quitChan   chan bool
+	reaperDone chan bool
+	saverDone  chan bool
+	closeOnce  sync.Once
+}
+
+// TrackerOptions controls the tracker.
+type TrackerOptions struct {
+	UDPPort int // Port for the UDP tracker (BEP 15); 0 means the HTTP port, -1 turns it off.
+
+	// How peers are chosen for announce responses; nil means RandomSelector.
+	Selector PeerSelector
+
+	// Peers handed out when the client doesn't say (0 means DEFAULT_NUMWANT), and the most
+	// handed out whatever it says (0 means MAX_NUMWANT).
+	DefaultNumWant int
+	MaxNumWant     int
+
+	// Peers that haven't announced for PeerTTL (0 means PEER_TIMEOUT) are dropped. The reaper
+	// looks for them every ReapInterval (0 means REAP_INTERVAL).
+	PeerTTL      time.Duration
+	ReapInterval time.Duration
+
+	// If set, swarms are saved to StateFile every SaveInterval (0 means SAVE_INTERVAL) and
+	// when the tracker is closed, and loaded from it when it starts.
+	StateFile    string
+	SaveInterval time.Duration
+
+	// Other distributors (HTTP host:port) to share swarms with, see cluster.go. Requests
+	// between them are signed with ClusterSecret. Announces are sent to them every
+	// ClusterSyncInterval (0 means CLUSTER_SYNC_INTERVAL).
+	ClusterMembers      []string
+	ClusterSecret       string
+	ClusterSyncInterval time.Duration
+
+	// If set, the admin endpoints (see admin.go) are served, to clients that send this token.
+	AdminToken string
+
+	// Info_hashes (20 bytes, as swarms are keyed) of torrents we don't serve but should track
+	// anyway, e.g. from LoadWhitelist.
+	Whitelist map[string]bool
+}
+
+// DefaultTrackerOptions runs the UDP tracker on the same port as the HTTP one and hands out
+// random peers.
+var DefaultTrackerOptions = TrackerOptions{
+	Selector:       RandomSelector{},
+	DefaultNumWant: DEFAULT_NUMWANT,
+	MaxNumWant:     MAX_NUMWANT,
+}
+
+// numwant returns how many peers to give a client that asked for requested of them; -1 means
+// it didn't say.
+func (self *Tracker) numwant(requested int) int {
+	defaultNumWant, maxNumWant := self.options.DefaultNumWant, self.options.MaxNumWant
+	if defaultNumWant == 0 {
+		defaultNumWant = DEFAULT_NUMWANT
+	}
+	if maxNumWant == 0 {
+		maxNumWant = MAX_NUMWANT
+	}
+	if requested < 0 {
+		requested = defaultNumWant
+	}
+	if requested > maxNumWant {
+		requested = maxNumWant
+	}
+	return requested
+}
+
+// allowed says whether we run a swarm for info_hash: it must be one of the torrents our
+// watchers generated, or whitelisted.
+func (self *Tracker) allowed(info_hash string) bool {
+	if self.registry == nil || self.options.Whitelist[info_hash] {
+		return true
+	}
+	return self.registry.Lookup(info_hash) != nil
+}
+
+// newMetadata builds the metadata for a torrent, announcing to our HTTP tracker at httpHost
+// (host:port, however the client reached us). If the UDP tracker is running it's advertised
+// too, as the first tier of the announce-list so clients that support it prefer it. The other
+// members of our cluster go in the same tiers, as they're as good as we are.
+func (self *Tracker) newMetadata(httpHost string, info *MetadataInfo) Metadata {
+	md := NewMetadata(fmt.Sprintf("http://%s/announce", httpHost), info)
+	httpTier, udpTier := []string{md.Announce}, []string{}
+	if self.udpPort != 0 {
+		host, _, err := net.SplitHostPort(httpHost)
+		if err != nil {
+			host = httpHost // No port given.
+		}
+		udpTier = append(udpTier, fmt.Sprintf("udp://%s/announce",
+			net.JoinHostPort(host, strconv.Itoa(self.udpPort))))
+	}
+	if self.cluster != nil {
+		httpURLs, udpURLs := self.cluster.announceURLs(self.httpPort)
+		httpTier = append(httpTier, httpURLs...)
+		udpTier = append(udpTier, udpURLs...)
+	}
+	if len(udpTier) > 0 {
+		md.AnnounceList = append(md.AnnounceList, udpTier)
+	}
+	if len(udpTier) > 0 || len(httpTier) > 1 {
+		md.AnnounceList = append(md.AnnounceList, httpTier)
+	}
+	return md
+}
+
+// findWatcher works out which of our watchers a requested path is in, and returns it and the
+// path relative to its directory. Paths start with the watcher's name (e.g. pkgs/foo.deb). If
+// there's only one watcher, paths relative to it work too, as they always have; when its
+// name could be either, it's taken to be the name.
+func (self *Tracker) findWatcher(name string) (*Watcher, string) {
+	watchers := self.getWatchers()
+	if pieces := strings.SplitN(name, "/", 2); len(pieces) == 2 {
+		if watcher := watchers[pieces[0]]; watcher != nil {
+			return watcher, pieces[1]
+		}
+	}
+	if len(watchers) == 1 {
+		for _, watcher := range watchers {
+			return watcher, name
+		}
+	}
+	return nil, ""
+}
+
+// getWatchers returns a copy of our watchers, by name.
+func (self *Tracker) getWatchers() map[string]*Watcher {
+	self.watchersLock.Lock()
+	defer self.watchersLock.Unlock()
+
+	watchers := make(map[string]*Watcher, len(self.watchers))
+	for name, watcher := range self.watchers {
+		watchers[name] = watcher
+	}
+	return watchers
+}
+
+// AddWatcher starts serving the files of a watcher, under name.
+func (self *Tracker) AddWatcher(name string, watcher *Watcher) error {
+	self.watchersLock.Lock()
+	defer self.watchersLock.Unlock()
+
+	if _, ok := self.watchers[name]; ok {
+		return errors.New(fmt.Sprintf("already serving %s", name))
+	}
+	self.watchers[name] = watcher
+	return nil
+}
+
+// RemoveWatcher stops serving the files of the watcher called name; no more seeds are started
+// for them. Returns the watcher, or nil if there isn't one by that name. The caller is
+// responsible for closing it and then stopping its seeds (see stopSeeds), in that order, so
+// files it's still sending on don't get seeded again.
+func (self *Tracker) RemoveWatcher(name string) *Watcher {
+	self.watchersLock.Lock()
+	defer self.watchersLock.Unlock()
+
+	watcher := self.watchers[name]
+	delete(self.watchers, name)
+	return watcher
+}
+
+// stopSeeds stops seeding files, e.g. those of a watcher we've removed.
+func (self *Tracker) stopSeeds(files []*File) {
+	for _, file := range files {
+		self.stopSeed(file)
+	}
+}
+
+// serving says whether one of our watchers is serving file right now. Must be called with
+// watchersLock held.
+func (self *Tracker) serving(file *File) bool {
 	for _, watcher := range self.watchers {
-		if file := watcher.GetFile(name); file != nil {
-			return file
+		if watcher.serves(file) {
+			return true
 		}
 	}
+	return false
+}
+
+// findFile finds a requested file (see findWatcher). If found, it returns the pointer to the
+// File structure representing this file.
+func (self *Tracker) findFile(name string) *File {
+	if watcher, localfn := self.findWatcher(name); watcher != nil {
+		return watcher.GetFile(localfn)
+	}
+	return nil
+}
+
+// findDir finds a requested subdirectory (see findWatcher) to serve as a multi-file torrent.
+func (self *Tracker) findDir(name string) *File {
+	if watcher, subdir := self.findWatcher(name); watcher != nil {
+		return watcher.GetDir(subdir)
+	}
 	return nil
 }
 
@@ -81,6 +406,7 @@ func (self *Tracker) findFile(name string) *File {
 // that exist (e.g. 0-length)
 func (self *Tracker) findLastUpdatedFile(watchers []*Watcher) *File {
 	var last_updated *File = nil
+	var last_updated_time time.Time
 	for _, watcher := range watchers {
 		for _, file := range watcher.GetFiles() {
 			file.Lock.Lock()
@@ -88,71 +414,182 @@ func (self *Tracker) findLastUpdatedFile(watchers []*Watcher) *File {
 				file.Lock.Unlock()
 				continue
 			}
+			modTime := file.ModTime
 			file.Lock.Unlock()
-			if last_updated == nil || file.ModTime.After(last_updated.ModTime) {
+			if last_updated == nil || modTime.After(last_updated_time) {
 				last_updated = file
+				last_updated_time = modTime
 			}
 		}
 	}
 	return last_updated
 }
 
-// startSeed attempts to start up a seeding process for a given torrent file.
+// startSeed asks our seeder to start seeding a given torrent file, unless we've stopped serving
+// it. If that would take us over the policy's limit, the seed that was requested least
+// recently is stopped first.
 func (self *Tracker) startSeed(file *File, metadata *Metadata) {
-	self.seedStartLock.Lock()
-
-	if file.SeedCommand != nil {
-		self.seedStartLock.Unlock()
+	self.watchersLock.Lock()
+	serving := self.serving(file)
+	self.watchersLock.Unlock()
+	if !serving {
+		LogDebug("Not seeding %s, it's no longer served.", file.Name)
 		return
 	}
 
-	tmp, err := ioutil.TempFile("", "distributor.")
-	if err != nil {
-		LogFatal("TempFile failed: %s", err)
+	self.seedLock.Lock()
+	self.seedUsed[file] = time.Now()
+
+	var evict *File
+	if self.policy.MaxSeeds > 0 && !self.seeder.Status(file).Running() {
+		running := 0
+		for tmpFile, used := range self.seedUsed {
+			if tmpFile == file {
+				continue
+			}
+			if !self.seeder.Status(tmpFile).Running() {
+				delete(self.seedUsed, tmpFile)
+				continue
+			}
+			running++
+			if evict == nil || used.Before(self.seedUsed[evict]) {
+				evict = tmpFile
+			}
+		}
+		if running < self.policy.MaxSeeds {
+			evict = nil
+		} else {
+			delete(self.seedUsed, evict)
+		}
 	}
-	LogDebug("Temporary file for %s: %s", file.Name, tmp.Name())
+	self.seedLock.Unlock()
 
-	err = bencode.Marshal(tmp, *metadata)
-	if err != nil {
-		self.seedStartLock.Unlock()
-		LogError("Failed to bencode %s: %s", file.Name, err)
-		return
+	if evict != nil {
+		LogInfo("Too many seeds, stopping least recently requested: %s", evict.Name)
+		if err := self.seeder.Stop(evict); err != nil {
+			LogError("Failed to stop seed for %s: %s", evict.Name, err)
+		}
 	}
 
-	err = tmp.Sync()
-	if err != nil {
-		self.seedStartLock.Unlock()
-		LogError("Failed to fsync: %s", err)
+	// Checked again while starting it, so a watcher that's being removed can't have the seed
+	// start after it stopped its seeds.
+	self.watchersLock.Lock()
+	defer self.watchersLock.Unlock()
+	if !self.serving(file) {
 		return
 	}
+	if err := self.seeder.Start(file, metadata); err != nil {
+		LogError("Failed to start seed for %s: %s", file.Name, err)
+	}
+}
+
+// stopSeed stops seeding a file, if we are, because we're not serving it anymore.
+func (self *Tracker) stopSeed(file *File) {
+	self.seedLock.Lock()
+	delete(self.seedUsed, file)
+	self.seedLock.Unlock()
+
+	if self.seeder.Status(file).Running() {
+		LogInfo("Stopping seed for %s.", file.Name)
+		if err := self.seeder.Stop(file); err != nil {
+			LogError("Failed to stop seed for %s: %s", file.Name, err)
+		}
+	}
+}
+
+// Handle adds an endpoint to our HTTP server.
+func (self *Tracker) Handle(pattern string, handler http.Handler) {
+	self.mux.Handle(pattern, handler)
+}
 
-	file.SeedCommand = exec.Command(
-		self.ctorrent,
-		"-s",
-		file.FQFN,
-		"-e",
-		"4",
-		"-p",
-		"8999",
-		tmp.Name())
-	self.seedStartLock.Unlock()
+// SeedEagerly starts seeding every file that comes in on the channel. Watchers send files here
+// as soon as their metadata is ready. Returns when the channel is closed.
+func (self *Tracker) SeedEagerly(ready chan *File) {
+	for file := range ready {
+		file.Lock.Lock()
+		mdinfo := file.MetadataInfo
+		file.Lock.Unlock()
+		if mdinfo == nil {
+			continue
+		}
 
-	// TODO: Read from output pipes, because they could fill up?
+		LogDebug("Eagerly seeding %s.", file.Name)
+		md := self.newMetadata(self.httpHost, mdinfo)
+		self.startSeed(file, &md)
+	}
+}
 
-	go func() {
-		LogDebug("Seed starting: %s", file.Name)
-		file.SeedCommand.Run()
-		LogDebug("Seed exited: %s", file.Name)
-
-		// Try to clean up temporary file.
-		tmp.Close()
-		os.Remove(tmp.Name())
-
-		// Seeds exit after 4 hours. Then they get restarted if someone requests them.
-		self.seedStartLock.Lock()
-		file.SeedCommand = nil
-		self.seedStartLock.Unlock()
-	}()
+// SeedReport is the seeding state of a single file, as returned by the /seed_status endpoint.
+type SeedReport struct {
+	File string `json:"file"` // Path of the file, as it's requested (name/path).
+	SeedStatus
+}
+
+// SeedStatuses returns the state of every file that has been seeded since we started.
+func (self *Tracker) SeedStatuses() []SeedReport {
+	reports := make([]SeedReport, 0)
+	for name, watcher := range self.getWatchers() {
+		for _, file := range append(watcher.GetFiles(), watcher.GetDirs()...) {
+			status := self.seeder.Status(file)
+			if status.State == SeedIdle {
+				continue
+			}
+			reports = append(reports, SeedReport{
+				File:       watcher.requestPath(name, file),
+				SeedStatus: status,
+			})
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].File < reports[j].File
+	})
+	return reports
+}
+
+// handleSeedStatus reports the state of our seeds as JSON, for humans and dashboards.
+func (self *Tracker) handleSeedStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(self.SeedStatuses()); err != nil {
+		LogError("Failed to encode seed status: %s", err)
+	}
+}
+
+// HashReport is the progress of a file whose metadata is being generated, as returned by the
+// /hash_progress endpoint. Hybrid torrents read every byte twice, so Total is double the size.
+type HashReport struct {
+	File   string `json:"file"`   // Path of the file, as it's requested (name/path).
+	Hashed int64  `json:"hashed"` // Bytes hashed so far.
+	Total  int64  `json:"total"`  // Bytes to hash in total.
+}
+
+// HashProgress returns the progress of every file that is currently being hashed.
+func (self *Tracker) HashProgress() []HashReport {
+	reports := make([]HashReport, 0)
+	for name, watcher := range self.getWatchers() {
+		for _, file := range append(watcher.GetFiles(), watcher.GetDirs()...) {
+			hashed, total := file.HashProgress()
+			if total == 0 {
+				continue
+			}
+			reports = append(reports, HashReport{
+				File:   watcher.requestPath(name, file),
+				Hashed: hashed,
+				Total:  total,
+			})
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].File < reports[j].File
+	})
+	return reports
+}
+
+// handleHashProgress reports the files we're generating metadata for as JSON.
+func (self *Tracker) handleHashProgress(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(self.HashProgress()); err != nil {
+		LogError("Failed to encode hash progress: %s", err)
+	}
 }
 
 // handleServe is the endpoint that is responsible for generating torrent files and giving them
@@ -170,6 +607,19 @@ func (self *Tracker) handleServe(w http.ResponseWriter, r *http.Request) {
 	self.serveFile(w, r, file)
 }
 
+// handleServeDir is the endpoint for fetching a torrent of a whole subdirectory.
+func (self *Tracker) handleServeDir(w http.ResponseWriter, r *http.Request) {
+	LogDebug("Request: %s", r.URL.RequestURI())
+	pieces := strings.SplitN(r.URL.RequestURI(), "?", 2)
+	if len(pieces) != 2 {
+		io.WriteString(w, "invalid request")
+		return
+	}
+
+	dir := self.findDir(pieces[1])
+	self.serveFile(w, r, dir)
+}
+
 // handleServeLatest is the endpoint that is responsible for serving the latest file that was updated
 func (self *Tracker) handleServeLastUpdated(w http.ResponseWriter, r *http.Request) {
 	LogDebug("Request: %s", r.URL.RequestURI())
@@ -182,7 +632,7 @@ func (self *Tracker) handleServeLastUpdated(w http.ResponseWriter, r *http.Reque
 		return
 	} else if len(pieces) == 2 {
 		// query the specified watcher
-		watcher := self.watchers[pieces[1]]
+		watcher := self.getWatchers()[pieces[1]]
 		if watcher == nil {
 			io.WriteString(w, "invalid watcher name")
 			return
@@ -190,7 +640,7 @@ func (self *Tracker) handleServeLastUpdated(w http.ResponseWriter, r *http.Reque
 		query_watchers = append(query_watchers, watcher)
 	} else {
 		// query all watchers
-		for _, watcher := range self.watchers {
+		for _, watcher := range self.getWatchers() {
 			query_watchers = append(query_watchers, watcher)
 		}
 	}
@@ -206,31 +656,35 @@ func (self *Tracker) serveFile(w http.ResponseWriter, r *http.Request, file *Fil
 	}
 
 	for {
-		// TODO: This could run infinitely in a case where the file is requested and deleted or
-		// replaced, so we keep checking a structure that never will get filled in since it's no
-		// longer active.
 		file.Lock.Lock()
-		if file.MetadataInfo == nil {
+		if file.MetadataInfo != nil {
 			file.Lock.Unlock()
-			LogDebug("Request for missing metadata on %v. Sleeping.", file.Name)
-			time.Sleep(1 * time.Second)
-			continue
+			break
 		}
 		file.Lock.Unlock()
-		break
+
+		// If the file was deleted, replaced or its root removed, it never gets metadata.
+		self.watchersLock.Lock()
+		serving := self.serving(file)
+		self.watchersLock.Unlock()
+		if !serving {
+			http.Error(w, "File not found", 404)
+			return
+		}
+		LogDebug("Request for missing metadata on %v. Sleeping.", file.Name)
+		select {
+		case <-time.After(1 * time.Second):
+		case <-r.Context().Done():
+			return // The client gave up.
+		}
 	}
 
 	file.Lock.Lock()
-	md := Metadata{
-		// Using Host like this is probably safe, but is potentially a hack.
-		Announce: fmt.Sprintf("http://%s/announce", r.Host),
-		Info:     *file.MetadataInfo,
-	}
+	// Using Host like this is probably safe, but is potentially a hack.
+	md := self.newMetadata(r.Host, file.MetadataInfo)
 	file.Lock.Unlock()
 
-	if file.SeedCommand == nil {
-		self.startSeed(file, &md)
-	}
+	self.startSeed(file, &md)
 
 	err := bencode.Marshal(w, md)
 	if err != nil {
@@ -240,48 +694,60 @@ func (self *Tracker) serveFile(w http.ResponseWriter, r *http.Request, file *Fil
 
 // parsePeer extracts a Peer structure from a query string.
 func parsePeer(r *http.Request, values url.Values) (*Peer, error) {
-	var peer_id, ip, strport []string
-	ok := true
+	peer_id, ok := values["peer_id"]
+	if !ok || len(peer_id) != 1 || peer_id[0] == "" {
+		return nil, errors.New("missing peer_id")
+	}
 
-	// I don't know how to make this cleaner in Go. Halp. :-(
-	peer_id, ok = values["peer_id"]
-	if ok && len(peer_id) == 1 {
-		strport, ok = values["port"]
+	strport, ok := values["port"]
+	if !ok || len(strport) != 1 {
+		return nil, errors.New("missing port")
 	}
-	if !ok {
-		return nil, errors.New("missing required argument")
+	port, err := strconv.ParseUint(strport[0], 10, 16)
+	if err != nil || port == 0 {
+		return nil, errors.New("invalid port")
 	}
 
-	ip, ok = values["ip"]
+	ip, ok := values["ip"]
 	if !ok {
-		// TODO: This seems fragile.
-		addr := strings.Split(r.RemoteAddr, ":")
-		if len(addr) != 2 {
-			LogFatal("Got weird address: %s", r.RemoteAddr)
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			LogError("Got weird address: %s", r.RemoteAddr)
+			return nil, errors.New("invalid remote address")
 		}
-		ip = []string{addr[0]}
+		ip = []string{host}
 	}
 
-	port, err := strconv.ParseUint(strport[0], 10, 16)
-	if err != nil {
-		return nil, errors.New("port invalid")
+	// The transfer stats are required by the spec, but we can do without them; a peer that
+	// doesn't say how much it has left is assumed to be downloading.
+	stats := map[string]int64{"uploaded": 0, "downloaded": 0, "left": -1}
+	for name := range stats {
+		if value := values.Get(name); value != "" {
+			if stats[name], err = strconv.ParseInt(value, 10, 64); err != nil || stats[name] < 0 {
+				return nil, errors.New("invalid " + name)
+			}
+		}
 	}
 
 	return &Peer{
-		Id:   peer_id[0],
-		Ip:   ip[0],
-		Port: uint16(port),
+		Id:         peer_id[0],
+		Ip:         normalizeIp(ip[0]),
+		Port:       uint16(port),
+		Uploaded:   stats["uploaded"],
+		Downloaded: stats["downloaded"],
+		Left:       stats["left"],
 	}, nil
 }
 
 // handleAnnounce is the endpoint for torrent clients to announce themselves and request
-// other peers.
+// other peers. Anything wrong with the request gets a bencoded failure reason, which clients
+// show to their user.
 func (self *Tracker) handleAnnounce(w http.ResponseWriter, r *http.Request) {
 	values := r.URL.Query()
 
 	peer, err := parsePeer(r, values)
 	if err != nil {
-		io.WriteString(w, err.Error())
+		writeFailure(w, err.Error())
 		return
 	}
 	LogDebug("Request from peer at %s:%d.", peer.Ip, peer.Port)
@@ -292,25 +758,83 @@ func (self *Tracker) handleAnnounce(w http.ResponseWriter, r *http.Request) {
 		info_hash = info_hash_list[0]
 	}
 
-	var event string
-	if event_list, ok := values["event"]; ok && len(event_list) == 1 {
-		event = event_list[0]
+	// v2 clients may send the full 32-byte SHA-256 info_hash. Everyone else (including v2
+	// clients talking to v1 trackers) uses it truncated to 20 bytes, so that's how we key
+	// the swarm.
+	if len(info_hash) == 32 {
+		info_hash = info_hash[:20]
+	} else if len(info_hash) != 20 {
+		writeFailure(w, "invalid info_hash")
+		return
+	}
+
+	if !self.allowed(info_hash) {
+		LogDebug("Announce from %s:%d for unknown info_hash %x.", peer.Ip, peer.Port, info_hash)
+		writeFailure(w, "unknown info_hash")
+		return
 	}
 
-	var numwant uint64
-	if numwant_list, ok := values["numwant"]; ok && len(numwant_list) == 1 {
-		numwant, err = strconv.ParseUint(numwant_list[0], 10, 8)
-		if err != nil || numwant > 100 {
-			numwant = 100
+	event := values.Get("event")
+	if !announceEvents[event] {
+		writeFailure(w, "invalid event")
+		return
+	}
+	if event == "empty" {
+		event = ""
+	}
+
+	// numwant is optional; negative numbers (some clients send -1) mean the default, and
+	// anything over our maximum gets the maximum, with a warning.
+	var warning string
+	numwant := -1
+	if value := values.Get("numwant"); value != "" {
+		requested, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			writeFailure(w, "invalid numwant")
+			return
+		}
+		if requested >= 0 {
+			numwant = int(requested)
+		}
+		if limit := self.numwant(numwant); limit < numwant {
+			warning = fmt.Sprintf("numwant %d is more than the limit of %d", numwant, limit)
 		}
-	} else {
-		numwant = 50
 	}
 
-	// Lock this now since we're validated our inputs.
-	self.peerListLock.Lock()
-	defer self.peerListLock.Unlock()
+	outPeers := self.announce(info_hash, peer, event, numwant)
+
+	// Build the output dictionary and return it.
+	interval := announceInterval()
+	if values.Get("compact") == "1" {
+		peers4, peers6 := compactPeers(outPeers)
+		writeBencoded(w, CompactPeerResponse{
+			Interval:       interval,
+			MinInterval:    MIN_ANNOUNCE_INTERVAL,
+			TrackerId:      self.trackerId,
+			WarningMessage: warning,
+			Peers:          peers4,
+			Peers6:         peers6,
+		})
+	} else {
+		if values.Get("no_peer_id") == "1" {
+			for i := range outPeers {
+				outPeers[i].Id = ""
+			}
+		}
+		writeBencoded(w, PeerResponse{
+			Interval:       interval,
+			MinInterval:    MIN_ANNOUNCE_INTERVAL,
+			TrackerId:      self.trackerId,
+			WarningMessage: warning,
+			Peers:          outPeers,
+		})
+	}
+}
 
+// updatePeer adds a peer to the swarm for info_hash, or updates it, as of when it was seen.
+// Updates older than what we have are ignored (they can arrive late from other members of our
+// cluster). Must be called with peerListLock held.
+func (self *Tracker) updatePeer(info_hash string, peer *Peer, event string, seen time.Time) {
 	peers, ok := self.PeerList[info_hash]
 	if !ok {
 		peers = make(map[string]Peer)
@@ -323,6 +847,14 @@ func (self *Tracker) handleAnnounce(w http.ResponseWriter, r *http.Request) {
 		self.PeerSeen[info_hash] = peerseen
 	}
 
+	if event == "completed" {
+		LogInfo("Peer %s:%d has completed its download.", peer.Ip, peer.Port)
+		self.Completed[info_hash]++
+	}
+	if last, ok := peerseen[peer.Id]; ok && last.After(seen) {
+		return
+	}
+
 	// Add this peer to the set if they don't exist, plus possibly purge other peers on this IP and port.
 	if _, ok := peers[peer.Id]; !ok {
 		// Remove any other peers on this IP address and port. This is kind of a hack since we don't have
@@ -338,13 +870,13 @@ func (self *Tracker) handleAnnounce(w http.ResponseWriter, r *http.Request) {
 			delete(peers, id)
 			delete(peerseen, id)
 		}
-
-		// Finally insert this new peer.
-		peers[peer.Id] = *peer
 	}
 
+	// Insert the peer, or update its stats.
+	peers[peer.Id] = *peer
+
 	// Always update the timestamp so we know when people report.
-	peerseen[peer.Id] = time.Now()
+	peerseen[peer.Id] = seen
 
 	// If they're stopping, then remove this peer from the valid list.
 	if event == "stopped" {
@@ -352,59 +884,221 @@ func (self *Tracker) handleAnnounce(w http.ResponseWriter, r *http.Request) {
 		delete(peers, peer.Id)
 		delete(peerseen, peer.Id)
 	}
+}
+
+// announce adds a peer to the swarm for info_hash, or updates it, and returns up to numwant
+// other peers in the swarm (-1 meaning the default number), chosen by our PeerSelector. This
+// is shared by the HTTP and UDP trackers.
+func (self *Tracker) announce(info_hash string, peer *Peer, event string, numwant int) []Peer {
+	now := time.Now()
+	if self.cluster != nil {
+		self.cluster.queue(clusterUpdate{InfoHash: info_hash, Peer: *peer, Event: event, Seen: now})
+	}
 
-	// We give the user back N random peers by just picking a window into our peer list.
-	ct := 0
-	outPeers := make([]Peer, 0, numwant)
+	self.peerListLock.Lock()
+	defer self.peerListLock.Unlock()
+
+	self.updatePeer(info_hash, peer, event, now)
+	peers, peerseen := self.PeerList[info_hash], self.PeerSeen[info_hash]
+
+	candidates := make([]Peer, 0, len(peers))
 	for id, tmpPeer := range peers {
 		// Don't hand out timed-out peers.
-		if time.Since(peerseen[id]) > 600*time.Second {
+		if time.Since(peerseen[id]) > self.peerTTL() {
 			delete(peers, id)
 			delete(peerseen, id)
 			continue
 		}
 
-		if ct++; ct > cap(outPeers) {
-			break
-		}
-
 		if tmpPeer.Ip == peer.Ip && tmpPeer.Port == peer.Port {
 			// This helps avoid giving peers connections to their own machine, which seems
 			// to confuse ctorrent. It seems to mostly affect small clusters.
 			continue
 		}
-		outPeers = append(outPeers, tmpPeer)
+		candidates = append(candidates, tmpPeer)
+	}
+
+	selector := self.options.Selector
+	if selector == nil {
+		selector = RandomSelector{}
+	}
+	swarm := &Swarm{InfoHash: info_hash, Peers: candidates}
+	outPeers := selector.SelectPeers(peer, swarm, self.numwant(numwant))
+	for _, tmpPeer := range outPeers {
 		LogDebug("[%s:%d] peer %s:%d", peer.Ip, peer.Port, tmpPeer.Ip, tmpPeer.Port)
 	}
 	LogInfo("Giving peer %s:%d a list of %d peers (out of %d).",
 		peer.Ip, peer.Port, len(outPeers), len(peers))
-
-	// Build the output dictionary and return it.
-	err = bencode.Marshal(w, PeerResponse{Interval: rand.Intn(120) + 300, Peers: outPeers})
-	if err != nil {
-		LogError("Failed to bencode: %s", err)
-	}
+	return outPeers
 }
 
-// starTracker spins up a tracker on a given ip:port for the given set of watchers.
+// starTracker spins up a tracker on a given ip:port for the given set of watchers. Announces
+// are only accepted for the info_hashes in registry (which the watchers should be feeding) or
+// the whitelist in options; a nil registry accepts anything.
 func StartTracker(ip string, port int,
-	ctorrentPath string,
-	watchers map[string]*Watcher) *Tracker {
+	seeder Seeder,
+	policy SeedPolicy,
+	watchers map[string]*Watcher,
+	registry *Registry,
+	options TrackerOptions) *Tracker {
+	// If we're listening on all addresses, our hostname is the best guess at how peers can
+	// reach us.
+	host := ip
+	if parsed := net.ParseIP(ip); host == "" || (parsed != nil && parsed.IsUnspecified()) {
+		if hostname, err := os.Hostname(); err == nil {
+			host = hostname
+		}
+	}
+
 	tracker := &Tracker{
-		PeerList: make(map[string]map[string]Peer),
-		PeerSeen: make(map[string]map[string]time.Time),
-		watchers: watchers,
-		ctorrent: ctorrentPath,
+		PeerList:  make(map[string]map[string]Peer),
+		PeerSeen:  make(map[string]map[string]time.Time),
+		Completed: make(map[string]int),
+		watchers:  watchers,
+		seeder:    seeder,
+		registry:  registry,
+		policy:    policy,
+		seedUsed:  make(map[*File]time.Time),
+		httpHost:  net.JoinHostPort(host, strconv.Itoa(port)),
+		httpPort:  port,
+		trackerId: newTrackerId(),
+		options:   options,
+		quitChan:  make(chan bool),
+	}
+
+	// Peers from before a restart can be handed out straight away; the ones that have gone
+	// away since will be reaped as usual.
+	if options.StateFile != "" {
+		loaded, err := tracker.loadState(options.StateFile, time.Now())
+		if err == nil {
+			LogInfo("Loaded %d peers from %s", loaded, options.StateFile)
+		} else if os.IsNotExist(err) {
+			LogInfo("No tracker state in %s, starting afresh.", options.StateFile)
+		} else {
+			LogError("Failed to load tracker state from %s: %s", options.StateFile, err)
+		}
 	}
 
-	http.HandleFunc("/serve", tracker.handleServe)
-	http.HandleFunc("/serve_last_updated", tracker.handleServeLastUpdated)
-	http.HandleFunc("/announce", tracker.handleAnnounce)
+	if options.UDPPort >= 0 {
+		udpPort := options.UDPPort
+		if udpPort == 0 {
+			udpPort = port
+		}
+		udp, err := startUDPTracker(tracker, ip, udpPort)
+		if err != nil {
+			// HTTP still works, so this isn't fatal.
+			LogError("Failed to start UDP tracker: %s", err)
+		} else {
+			tracker.udp = udp
+			tracker.udpPort = udp.port()
+		}
+	}
+
+	mux := http.NewServeMux()
+	tracker.mux = mux
+	mux.HandleFunc("/serve", tracker.handleServe)
+	mux.HandleFunc("/serve_dir", tracker.handleServeDir)
+	mux.HandleFunc("/serve_last_updated", tracker.handleServeLastUpdated)
+	mux.HandleFunc("/announce", tracker.handleAnnounce)
+	mux.HandleFunc("/scrape", tracker.handleScrape)
+	mux.HandleFunc("/seed_status", tracker.handleSeedStatus)
+	mux.HandleFunc("/hash_progress", tracker.handleHashProgress)
+	if len(options.ClusterMembers) > 0 {
+		tracker.cluster = newCluster(tracker, options.ClusterMembers, options.ClusterSecret)
+		mux.HandleFunc("/cluster/sync", tracker.cluster.handleSync)
+		mux.HandleFunc("/cluster/state", tracker.cluster.handleState)
+	}
+	tracker.server = &http.Server{
+		Addr:    net.JoinHostPort(ip, strconv.Itoa(port)),
+		Handler: mux,
+	}
 
 	go func() {
-		err := http.ListenAndServe(fmt.Sprintf("%s:%d", ip, port), nil)
-		LogFatal("HTTP server exited: %s", err)
+		err := tracker.server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			LogFatal("HTTP server exited: %s", err)
+		}
 	}()
 
+	tracker.startReaper()
+	tracker.startSaver()
+	if tracker.cluster != nil {
+		tracker.clusterDone = tracker.cluster.start(options.ClusterSyncInterval)
+	}
 	return tracker
 }
+
+// Close shuts down the tracker: the HTTP and UDP servers, the reaper, the saver, which saves
+// our swarms one last time, and the cluster, which sends out the last announces.
+func (self *Tracker) Close() {
+	self.closeOnce.Do(func() {
+		if self.server != nil {
+			self.server.Close()
+		}
+		if self.udp != nil {
+			self.udp.Close()
+		}
+		close(self.quitChan)
+		if self.reaperDone != nil {
+			<-self.reaperDone
+		}
+		if self.saverDone != nil {
+			<-self.saverDone
+		}
+		if self.clusterDone != nil {
+			<-self.clusterDone
+		}
+	})
+}
+
+// Scrape returns the state of the swarms for the given info_hashes, or of all of them if none
+// are given. Unknown info_hashes are included, with everything 0.
+func (self *Tracker) Scrape(info_hashes []string) map[string]ScrapeFile {
+	self.peerListLock.Lock()
+	defer self.peerListLock.Unlock()
+
+	if len(info_hashes) == 0 {
+		info_hashes = self.swarmHashes()
+		for info_hash := range self.Completed {
+			if _, ok := self.PeerList[info_hash]; !ok {
+				if _, ok := self.PeerSeen[info_hash]; !ok {
+					info_hashes = append(info_hashes, info_hash)
+				}
+			}
+		}
+	}
+
+	files := make(map[string]ScrapeFile)
+	for _, info_hash := range info_hashes {
+		file := ScrapeFile{Downloaded: self.Completed[info_hash]}
+		for id, peer := range self.PeerList[info_hash] {
+			if time.Since(self.PeerSeen[info_hash][id]) > self.peerTTL() {
+				continue
+			}
+			if peer.Left == 0 {
+				file.Complete++
+			} else {
+				file.Incomplete++
+			}
+		}
+		files[info_hash] = file
+	}
+	return files
+}
+
+// handleScrape is the endpoint for asking about the state of swarms without joining them.
+func (self *Tracker) handleScrape(w http.ResponseWriter, r *http.Request) {
+	var info_hashes []string
+	for _, info_hash := range r.URL.Query()["info_hash"] {
+		// As for announces, swarms are keyed by the first 20 bytes of v2 info_hashes.
+		if len(info_hash) == 32 {
+			info_hash = info_hash[:20]
+		} else if len(info_hash) != 20 {
+			writeFailure(w, "invalid info_hash")
+			return
+		}
+		info_hashes = append(info_hashes, info_hash)
+	}
+
+	writeBencoded(w, ScrapeResponse{Files: self.Scrape(info_hashes)})
+}
@@ -0,0 +1,265 @@
+package torrent
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	bencode "github.com/jackpal/bencode-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTracker() *Tracker {
+	return &Tracker{
+		PeerList:  make(map[string]map[string]Peer),
+		PeerSeen:  make(map[string]map[string]time.Time),
+		Completed: make(map[string]int),
+		seeder:    NullSeeder{},
+		seedUsed:  make(map[*File]time.Time),
+		quitChan:  make(chan bool),
+	}
+}
+
+// announce sends an announce to the tracker from remoteAddr and decodes the response.
+func announce(t *testing.T, tracker *Tracker, remoteAddr string,
+	values url.Values) map[string]interface{} {
+	if values.Get("info_hash") == "" {
+		values.Set("info_hash", strings.Repeat("i", 20))
+	}
+	r := httptest.NewRequest("GET", "/announce?"+values.Encode(), nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	tracker.handleAnnounce(w, r)
+
+	response, err := bencode.Decode(strings.NewReader(w.Body.String()))
+	if !assert.Nil(t, err, "response: %q", w.Body.String()) {
+		return nil
+	}
+	return response.(map[string]interface{})
+}
+
+func TestAnnounceCompact(t *testing.T) {
+	tracker := newTestTracker()
+	announce(t, tracker, "10.0.0.1:5000", url.Values{"peer_id": {"aaaa"}, "port": {"6881"}})
+	announce(t, tracker, "[2001:db8::1]:5000",
+		url.Values{"peer_id": {"bbbb"}, "port": {"6882"}})
+	announce(t, tracker, "[::ffff:10.0.0.3]:5000",
+		url.Values{"peer_id": {"cccc"}, "port": {"6883"}})
+
+	response := announce(t, tracker, "10.0.0.9:5000",
+		url.Values{"peer_id": {"zzzz"}, "port": {"1"}, "compact": {"1"}})
+	peers := response["peers"].(string)
+	assert.Len(t, peers, 12)
+	assert.Contains(t, peers, "\x0a\x00\x00\x01\x1a\xe1")
+	assert.Contains(t, peers, "\x0a\x00\x00\x03\x1a\xe3", "IPv4-mapped addresses are IPv4")
+	assert.Equal(t,
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2",
+		response["peers6"])
+}
+
+func TestAnnounceDictionary(t *testing.T) {
+	tracker := newTestTracker()
+	announce(t, tracker, "[2001:db8::1]:5000",
+		url.Values{"peer_id": {"bbbb"}, "port": {"6882"}})
+
+	response := announce(t, tracker, "10.0.0.9:5000",
+		url.Values{"peer_id": {"zzzz"}, "port": {"1"}})
+	peers := response["peers"].([]interface{})
+	assert.Len(t, peers, 1)
+	peer := peers[0].(map[string]interface{})
+	assert.Equal(t, "2001:db8::1", peer["ip"])
+	assert.Equal(t, "bbbb", peer["peer id"])
+
+	response = announce(t, tracker, "10.0.0.9:5000",
+		url.Values{"peer_id": {"zzzz"}, "port": {"1"}, "no_peer_id": {"1"}})
+	peer = response["peers"].([]interface{})[0].(map[string]interface{})
+	assert.NotContains(t, peer, "peer id")
+}
+
+func TestAnnounceWeirdRemoteAddr(t *testing.T) {
+	r := httptest.NewRequest("GET", "/announce?peer_id=a&port=1", nil)
+	r.RemoteAddr = "garbage"
+	_, err := parsePeer(r, r.URL.Query())
+	assert.NotNil(t, err, "should not be fatal")
+
+	r.RemoteAddr = "[fe80::1%eth0]:80"
+	peer, err := parsePeer(r, r.URL.Query())
+	assert.Nil(t, err)
+	assert.Equal(t, "fe80::1%eth0", peer.Ip)
+}
+
+func TestScrape(t *testing.T) {
+	tracker := newTestTracker()
+	hash := strings.Repeat("h", 20)
+	other := strings.Repeat("o", 20)
+	announce(t, tracker, "10.0.0.1:5000", url.Values{"peer_id": {"seed"}, "port": {"1"},
+		"info_hash": {hash}, "left": {"0"}})
+	announce(t, tracker, "10.0.0.2:5000", url.Values{"peer_id": {"leech"}, "port": {"1"},
+		"info_hash": {hash}, "left": {"1000"}, "downloaded": {"24"}})
+	announce(t, tracker, "10.0.0.3:5000", url.Values{"peer_id": {"done"}, "port": {"1"},
+		"info_hash": {hash}, "left": {"1000"}})
+	announce(t, tracker, "10.0.0.3:5000", url.Values{"peer_id": {"done"}, "port": {"1"},
+		"info_hash": {hash}, "left": {"0"}, "event": {"completed"}})
+	announce(t, tracker, "10.0.0.4:5000", url.Values{"peer_id": {"old"}, "port": {"1"},
+		"info_hash": {other}})
+
+	assert.Equal(t, int64(24), tracker.PeerList[hash]["leech"].Downloaded)
+	assert.Equal(t, map[string]ScrapeFile{
+		hash: {Complete: 2, Incomplete: 1, Downloaded: 1},
+	}, tracker.Scrape([]string{hash}))
+	assert.Len(t, tracker.Scrape(nil), 2, "all swarms")
+
+	r := httptest.NewRequest("GET", "/scrape?"+url.Values{"info_hash": {other}}.Encode(), nil)
+	w := httptest.NewRecorder()
+	tracker.handleScrape(w, r)
+	response, err := bencode.Decode(strings.NewReader(w.Body.String()))
+	assert.Nil(t, err)
+	files := response.(map[string]interface{})["files"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{
+		"complete": int64(0), "incomplete": int64(1), "downloaded": int64(0),
+	}, files[other])
+}
+
+func TestAnnounceUnknownInfoHash(t *testing.T) {
+	tracker := newTestTracker()
+	tracker.registry = NewRegistry()
+	mdinfo := &MetadataInfo{Name: "file", PieceLength: 16384, Pieces: strings.Repeat("p", 20),
+		Length: 1}
+	assert.Nil(t, tracker.registry.Register(&File{Name: "file"}, mdinfo))
+	ours, _ := mdinfo.InfoHash()
+	whitelisted := strings.Repeat("w", 20)
+	tracker.options.Whitelist = map[string]bool{whitelisted: true}
+
+	response := announce(t, tracker, "10.0.0.1:5000", url.Values{"peer_id": {"aaaa"},
+		"port": {"1"}, "info_hash": {strings.Repeat("x", 20)}})
+	assert.Equal(t, map[string]interface{}{"failure reason": "unknown info_hash"}, response)
+	assert.Empty(t, tracker.PeerList, "no swarm for unknown info_hashes")
+
+	for _, info_hash := range []string{string(ours), whitelisted} {
+		response = announce(t, tracker, "10.0.0.1:5000", url.Values{"peer_id": {"aaaa"},
+			"port": {"1"}, "info_hash": {info_hash}})
+		assert.NotContains(t, response, "failure reason")
+		assert.Contains(t, tracker.PeerList, info_hash)
+	}
+}
+
+func TestAnnounceFailures(t *testing.T) {
+	tracker := newTestTracker()
+	for reason, values := range map[string]url.Values{
+		"missing peer_id":   {"port": {"1"}},
+		"missing port":      {"peer_id": {"aaaa"}},
+		"invalid port":      {"peer_id": {"aaaa"}, "port": {"0"}},
+		"invalid left":      {"peer_id": {"aaaa"}, "port": {"1"}, "left": {"-5"}},
+		"invalid info_hash": {"peer_id": {"aaaa"}, "port": {"1"}, "info_hash": {"short"}},
+		"invalid event":     {"peer_id": {"aaaa"}, "port": {"1"}, "event": {"paused"}},
+		"invalid numwant":   {"peer_id": {"aaaa"}, "port": {"1"}, "numwant": {"lots"}},
+	} {
+		response := announce(t, tracker, "10.0.0.1:5000", values)
+		assert.Equal(t, map[string]interface{}{"failure reason": reason}, response)
+	}
+	for _, port := range []string{"x", "65536", "-1"} {
+		response := announce(t, tracker, "10.0.0.1:5000",
+			url.Values{"peer_id": {"aaaa"}, "port": {port}})
+		assert.Equal(t, "invalid port", response["failure reason"], "port %s", port)
+	}
+	assert.Empty(t, tracker.PeerList, "failed announces don't join the swarm")
+}
+
+func TestAnnounceResponseFields(t *testing.T) {
+	tracker := newTestTracker()
+	tracker.trackerId = "tracker1"
+	for i := 0; i < MAX_NUMWANT+10; i++ {
+		tracker.announce(strings.Repeat("i", 20),
+			&Peer{Id: strconv.Itoa(i), Ip: "10.0.0.1", Port: uint16(i + 1)}, "", 0)
+	}
+
+	response := announce(t, tracker, "10.0.0.9:5000", url.Values{"peer_id": {"zzzz"},
+		"port": {"1"}, "event": {"empty"}, "numwant": {"-1"}})
+	assert.Len(t, response["peers"], DEFAULT_NUMWANT, "negative numwant means the default")
+	assert.Equal(t, int64(MIN_ANNOUNCE_INTERVAL), response["min interval"])
+	assert.True(t, response["interval"].(int64) >= ANNOUNCE_INTERVAL)
+	assert.Equal(t, "tracker1", response["tracker id"])
+	assert.NotContains(t, response, "warning message")
+
+	response = announce(t, tracker, "10.0.0.9:5000", url.Values{"peer_id": {"zzzz"},
+		"port": {"1"}, "numwant": {"1000"}, "compact": {"1"}})
+	assert.Len(t, response["peers"], MAX_NUMWANT*6)
+	assert.Equal(t, "numwant 1000 is more than the limit of 100", response["warning message"])
+
+	response = announce(t, tracker, "10.0.0.9:5000", url.Values{"peer_id": {"zzzz"},
+		"port": {"1"}, "numwant": {"0"}})
+	assert.Empty(t, response["peers"])
+}
+
+func TestFindFileInRoots(t *testing.T) {
+	newWatcher := func(dir string, files ...string) *Watcher {
+		watcher := &Watcher{Directory: dir, Files: make(map[string]*File)}
+		for _, localfn := range files {
+			watcher.Files[localfn] = &File{FQFN: dir + "/" + localfn}
+		}
+		return watcher
+	}
+	tracker := newTestTracker()
+	tracker.watchers = map[string]*Watcher{
+		"pkgs":   newWatcher("/srv/pkgs", "foo.deb", "pkgs/bar.deb"),
+		"images": newWatcher("/srv/images", "foo.deb"),
+	}
+
+	assert.Equal(t, "/srv/pkgs/foo.deb", tracker.findFile("pkgs/foo.deb").FQFN)
+	assert.Equal(t, "/srv/images/foo.deb", tracker.findFile("images/foo.deb").FQFN)
+	assert.Equal(t, "/srv/pkgs/pkgs/bar.deb", tracker.findFile("pkgs/pkgs/bar.deb").FQFN)
+	assert.Nil(t, tracker.findFile("foo.deb"), "ambiguous without a root name")
+	assert.Nil(t, tracker.findFile("other/foo.deb"))
+
+	// With a single root, paths relative to it work as well.
+	delete(tracker.watchers, "images")
+	assert.Equal(t, "/srv/pkgs/foo.deb", tracker.findFile("foo.deb").FQFN)
+	assert.Equal(t, "/srv/pkgs/foo.deb", tracker.findFile("pkgs/foo.deb").FQFN,
+		"the root name wins")
+	assert.Nil(t, tracker.findFile("pkgs/bar.deb"))
+}
+
+func TestServeGivesUpOnRemovedFiles(t *testing.T) {
+	file := &File{Name: "file"}
+	tracker := newTestTracker()
+	tracker.watchers = map[string]*Watcher{"srv": servingWatcher(file)}
+
+	// Requests wait for the metadata, until the file goes away.
+	served := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		tracker.handleServe(w, httptest.NewRequest("GET", "/serve?srv/file", nil))
+		served <- w.Code
+	}()
+	select {
+	case <-served:
+		t.Fatal("served a file without metadata")
+	case <-time.After(100 * time.Millisecond):
+	}
+	tracker.RemoveWatcher("srv").purge()
+	select {
+	case code := <-served:
+		assert.Equal(t, 404, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting for metadata that will never come")
+	}
+
+	// And when the client gives up.
+	tracker.watchers["srv"] = servingWatcher(file)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		r := httptest.NewRequest("GET", "/serve?srv/file", nil).WithContext(ctx)
+		tracker.handleServe(httptest.NewRecorder(), r)
+		served <- 0
+	}()
+	cancel()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting after the client went away")
+	}
+}
@@ -0,0 +1,268 @@
+/*
+ * udp.go
+ *
+ * UDP tracker protocol (BEP 15). Much cheaper than HTTP for the thousands of hosts that
+ * re-announce every few minutes. Peers are kept in the same swarms as the HTTP tracker, so
+ * clients using either one see each other.
+ *
+ * Copyright (c) 2014 by authors and contributors. Please see the included LICENSE file for
+ * licensing information.
+ *
+ */
+
+package torrent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Magic constant that starts every connect request.
+const UDP_PROTOCOL_ID = int64(0x41727101980)
+
+// Actions, which identify the type of each request and response.
+const (
+	udpConnect  = int32(0)
+	udpAnnounce = int32(1)
+	udpScrape   = int32(2)
+	udpError    = int32(3)
+)
+
+// Connection IDs are valid for between one and two of these, so clients (which reuse them for
+// a minute) never see one expire.
+const UDP_CONNECTION_LIFETIME = time.Minute
+
+// Most info_hashes in a scrape request, which keeps the response within a single packet.
+const UDP_MAX_SCRAPE = 74
+
+// Events in announce requests, in the order the spec numbers them.
+var udpEvents = []string{"", "completed", "started", "stopped"}
+
+// udpTracker serves the UDP protocol for a Tracker.
+type udpTracker struct {
+	tracker *Tracker
+	conn    net.PacketConn
+	secret  []byte // Connection IDs are signed with this, so we don't need to remember them.
+}
+
+// Fixed-size parts of the requests, all big-endian.
+type udpHeader struct {
+	ConnectionId  int64
+	Action        int32
+	TransactionId int32
+}
+
+type udpAnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerId     [20]byte
+	Downloaded int64
+	Left       int64
+	Uploaded   int64
+	Event      int32
+	Ip         uint32 // 0 means the sender's address.
+	Key        uint32
+	NumWant    int32 // -1 means the default.
+	Port       uint16
+}
+
+// startUDPTracker starts listening for UDP tracker requests on ip:port.
+func startUDPTracker(tracker *Tracker, ip string, port int) (*udpTracker, error) {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	self := &udpTracker{
+		tracker: tracker,
+		conn:    conn,
+		secret:  make([]byte, 32),
+	}
+	if _, err := rand.Read(self.secret); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	LogInfo("UDP tracker listening on %s", conn.LocalAddr())
+	go self.serve()
+	return self, nil
+}
+
+// port returns the port we're listening on.
+func (self *udpTracker) port() int {
+	return self.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Close stops the UDP tracker.
+func (self *udpTracker) Close() error {
+	return self.conn.Close()
+}
+
+// serve handles requests until the connection is closed. Requests are cheap, so they're
+// handled one at a time.
+func (self *udpTracker) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := self.conn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			LogDebug("UDP tracker exiting: %s", err)
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if response := self.handle(buf[:n], udpAddr); response != nil {
+			if _, err := self.conn.WriteTo(response, addr); err != nil {
+				LogDebug("Failed to send UDP response to %s: %s", addr, err)
+			}
+		}
+	}
+}
+
+// writeBigEndian writes each of the values to buf, big-endian.
+func writeBigEndian(buf *bytes.Buffer, values ...interface{}) {
+	for _, value := range values {
+		binary.Write(buf, binary.BigEndian, value)
+	}
+}
+
+// connectionId returns the connection ID for a client in the given period of time. It's a
+// signature of the client's IP, so it can't be guessed.
+func (self *udpTracker) connectionId(ip net.IP, period int64) int64 {
+	mac := hmac.New(sha256.New, self.secret)
+	mac.Write(ip.To16())
+	binary.Write(mac, binary.BigEndian, period)
+	return int64(binary.BigEndian.Uint64(mac.Sum(nil)))
+}
+
+// validConnectionId checks a connection ID from a client, accepting the ones we handed out in
+// this period or the last one.
+func (self *udpTracker) validConnectionId(ip net.IP, id int64) bool {
+	period := time.Now().UnixNano() / int64(UDP_CONNECTION_LIFETIME)
+	return id == self.connectionId(ip, period) || id == self.connectionId(ip, period-1)
+}
+
+// handle processes a single request packet and returns the response to send, if any.
+func (self *udpTracker) handle(packet []byte, addr *net.UDPAddr) []byte {
+	var header udpHeader
+	reader := bytes.NewReader(packet)
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		return nil // Too short to even reply to.
+	}
+
+	var response bytes.Buffer
+	var err error
+	if header.Action == udpConnect {
+		if header.ConnectionId != UDP_PROTOCOL_ID {
+			return nil
+		}
+		period := time.Now().UnixNano() / int64(UDP_CONNECTION_LIFETIME)
+		writeBigEndian(&response, udpConnect, header.TransactionId,
+			self.connectionId(addr.IP, period))
+	} else if !self.validConnectionId(addr.IP, header.ConnectionId) {
+		err = errors.New("invalid connection id")
+	} else if header.Action == udpAnnounce {
+		err = self.handleAnnounce(reader, addr, header, &response)
+	} else if header.Action == udpScrape {
+		err = self.handleScrape(reader, header, &response)
+	} else {
+		err = errors.New("unknown action")
+	}
+
+	if err != nil {
+		LogDebug("UDP request from %s failed: %s", addr, err)
+		response.Reset()
+		writeBigEndian(&response, udpError, header.TransactionId)
+		response.WriteString(err.Error())
+	}
+	return response.Bytes()
+}
+
+// handleAnnounce adds the client to the swarm and writes the announce response. IPv4 clients
+// get IPv4 peers (6 bytes each) and IPv6 clients get IPv6 peers (18 bytes each).
+func (self *udpTracker) handleAnnounce(reader *bytes.Reader, addr *net.UDPAddr,
+	header udpHeader, response *bytes.Buffer) error {
+	var request udpAnnounceRequest
+	if err := binary.Read(reader, binary.BigEndian, &request); err != nil {
+		return errors.New("announce too short")
+	}
+	if request.Event < 0 || int(request.Event) >= len(udpEvents) {
+		return errors.New("invalid event")
+	}
+	if request.Downloaded < 0 || request.Left < 0 || request.Uploaded < 0 {
+		return errors.New("invalid transfer stats")
+	}
+	if request.Port == 0 {
+		return errors.New("invalid port")
+	}
+
+	ip := addr.IP
+	if ip4 := ip.To4(); ip4 != nil && request.Ip != 0 {
+		// Like the ip parameter of HTTP announces, we trust clients to say where they are.
+		ip = make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, request.Ip)
+	}
+	peer := &Peer{
+		Id:         string(request.PeerId[:]),
+		Ip:         normalizeIp(ip.String()),
+		Port:       request.Port,
+		Uploaded:   request.Uploaded,
+		Downloaded: request.Downloaded,
+		Left:       request.Left,
+	}
+	LogDebug("UDP request from peer at %s:%d.", peer.Ip, peer.Port)
+
+	info_hash := string(request.InfoHash[:])
+	if !self.tracker.allowed(info_hash) {
+		return errors.New("unknown info_hash")
+	}
+
+	numwant := int(request.NumWant)
+	if numwant < 0 {
+		numwant = -1
+	}
+	peers := self.tracker.announce(info_hash, peer, udpEvents[request.Event], numwant)
+	swarm := self.tracker.Scrape([]string{info_hash})[info_hash]
+
+	writeBigEndian(response, udpAnnounce, header.TransactionId, int32(announceInterval()),
+		int32(swarm.Incomplete), int32(swarm.Complete))
+	peers4, peers6 := compactPeers(peers)
+	if addr.IP.To4() != nil {
+		response.WriteString(peers4)
+	} else {
+		response.WriteString(peers6)
+	}
+	return nil
+}
+
+// handleScrape writes the seeders, completed downloads and leechers for each info_hash in the
+// request, in the order they were asked for.
+func (self *udpTracker) handleScrape(reader *bytes.Reader, header udpHeader,
+	response *bytes.Buffer) error {
+	if reader.Len() == 0 || reader.Len()%20 != 0 || reader.Len()/20 > UDP_MAX_SCRAPE {
+		return errors.New("invalid info_hash list")
+	}
+	var info_hashes []string
+	for reader.Len() > 0 {
+		info_hash := make([]byte, 20)
+		reader.Read(info_hash)
+		info_hashes = append(info_hashes, string(info_hash))
+	}
+
+	swarms := self.tracker.Scrape(info_hashes)
+	writeBigEndian(response, udpScrape, header.TransactionId)
+	for _, info_hash := range info_hashes {
+		swarm := swarms[info_hash]
+		writeBigEndian(response, int32(swarm.Complete), int32(swarm.Downloaded),
+			int32(swarm.Incomplete))
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// udpRequest sends a request to the UDP tracker and returns the response.
+func udpRequest(t *testing.T, conn net.Conn, values ...interface{}) []byte {
+	var request bytes.Buffer
+	writeBigEndian(&request, values...)
+	_, err := conn.Write(request.Bytes())
+	assert.Nil(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	return buf[:n]
+}
+
+func TestUDPTracker(t *testing.T) {
+	tracker := newTestTracker()
+	udp, err := startUDPTracker(tracker, "127.0.0.1", 0)
+	assert.Nil(t, err)
+	defer udp.Close()
+
+	conn, err := net.Dial("udp", udp.conn.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// A peer that announced over HTTP, which should be in the same swarm.
+	hash := strings.Repeat("h", 20)
+	announce(t, tracker, "10.0.0.1:5000", url.Values{"peer_id": {"http"}, "port": {"6881"},
+		"info_hash": {hash}, "left": {"0"}})
+
+	response := udpRequest(t, conn, UDP_PROTOCOL_ID, udpConnect, int32(1234))
+	assert.Len(t, response, 16)
+	assert.Equal(t, uint32(udpConnect), binary.BigEndian.Uint32(response[0:]))
+	assert.Equal(t, uint32(1234), binary.BigEndian.Uint32(response[4:]))
+	connectionId := int64(binary.BigEndian.Uint64(response[8:]))
+
+	var peerId [20]byte
+	copy(peerId[:], "udp")
+	var infoHash [20]byte
+	copy(infoHash[:], hash)
+	response = udpRequest(t, conn, connectionId, udpAnnounce, int32(99),
+		udpAnnounceRequest{InfoHash: infoHash, PeerId: peerId, Left: 100, Event: 2,
+			NumWant: -1, Port: 7000})
+	assert.Len(t, response, 20+6)
+	assert.Equal(t, uint32(udpAnnounce), binary.BigEndian.Uint32(response[0:]))
+	assert.Equal(t, uint32(99), binary.BigEndian.Uint32(response[4:]))
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(response[12:]), "leechers")
+	assert.Equal(t, uint32(1), binary.BigEndian.Uint32(response[16:]), "seeders")
+	assert.Equal(t, []byte{10, 0, 0, 1, 0x1a, 0xe1}, response[20:])
+	tracker.peerListLock.Lock()
+	assert.Equal(t, "127.0.0.1", tracker.PeerList[hash][string(peerId[:])].Ip)
+	tracker.peerListLock.Unlock()
+
+	response = udpRequest(t, conn, connectionId, udpScrape, int32(5), infoHash,
+		[20]byte{})
+	assert.Equal(t, []byte{0, 0, 0, 2, 0, 0, 0, 5, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, response)
+
+	response = udpRequest(t, conn, connectionId+1, udpScrape, int32(6), infoHash)
+	assert.Equal(t, uint32(udpError), binary.BigEndian.Uint32(response[0:]))
+	assert.Equal(t, "invalid connection id", string(response[8:]))
+
+	// Like HTTP announces, ones without a port are refused.
+	copy(peerId[:], "noport")
+	response = udpRequest(t, conn, connectionId, udpAnnounce, int32(7),
+		udpAnnounceRequest{InfoHash: infoHash, PeerId: peerId, Left: 100, NumWant: -1})
+	assert.Equal(t, uint32(udpError), binary.BigEndian.Uint32(response[0:]))
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32(response[4:]))
+	assert.Equal(t, "invalid port", string(response[8:]))
+	tracker.peerListLock.Lock()
+	assert.NotContains(t, tracker.PeerList[hash], string(peerId[:]))
+	tracker.peerListLock.Unlock()
+}
+
+func TestAnnounceListIncludesUDP(t *testing.T) {
+	tracker := newTestTracker()
+	info := &MetadataInfo{Name: "test"}
+	md := tracker.newMetadata("example.com:6390", info)
+	assert.Equal(t, "http://example.com:6390/announce", md.Announce)
+	assert.Nil(t, md.AnnounceList)
+
+	tracker.udpPort = 6391
+	md = tracker.newMetadata("example.com:6390", info)
+	assert.Equal(t, [][]string{
+		{"udp://example.com:6391/announce"},
+		{"http://example.com:6390/announce"},
+	}, md.AnnounceList)
+	md = tracker.newMetadata("[::1]:6390", info)
+	assert.Equal(t, "udp://[::1]:6391/announce", md.AnnounceList[0][0])
+}
@@ -9,37 +9,181 @@
 package torrent
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
+// WatcherOptions controls which files a watcher publishes, and when.
+type WatcherOptions struct {
+	// How long a file's size and modification time must stay the same before it's hashed and
+	// published, so files that are still being copied in aren't. With 0, files are hashed as
+	// soon as they change. On Linux, a file that's closed after being written is published
+	// straight away, unless we're polling.
+	SettleTime time.Duration
+
+	// If set, files being written under one of these suffixes (".part", say) are never served,
+	// and new files are only published when they're renamed into place from one, in the same
+	// directory. Files renamed into place are published straight away, regardless of
+	// SettleTime. Files already there when we start, or in directories that appear later, are
+	// published as usual.
+	StagingSuffixes []string
+
+	// Which files to serve, by their path relative to the watched directory. Globs without a
+	// slash are matched against the file's name, others against the whole path; regexps are
+	// always matched against the whole path. If there are any includes, only files matching
+	// one are served. Files matching an exclude never are, and neither are the files in
+	// directories that match one.
+	IncludeGlobs   []string
+	ExcludeGlobs   []string
+	IncludeRegexps []*regexp.Regexp
+	ExcludeRegexps []*regexp.Regexp
+
+	// Size limits for the files we serve; 0 means no limit. Files are picked up when they grow
+	// to MinSize, and dropped if they grow past MaxSize.
+	MinSize int64
+	MaxSize int64
+
+	// If set, symlinks are ignored. Otherwise they're followed, to files and directories alike
+	// (except to directories they're in).
+	SkipSymlinks bool
+
+	// If set, the directory is scanned for changes this often instead of being watched with
+	// fsnotify, which doesn't work on NFS or FUSE mounts. Directories that can't be watched
+	// (because we're out of inotify watches, say) are scanned regardless, every POLL_INTERVAL
+	// if this isn't set.
+	PollInterval time.Duration
+}
+
+// DefaultWatcherOptions publishes every file as soon as it changes.
+var DefaultWatcherOptions = WatcherOptions{}
+
+// Validate checks that the settle time, staging suffixes and filters are usable.
+func (self WatcherOptions) Validate() error {
+	if self.SettleTime < 0 {
+		return errors.New(fmt.Sprintf("settle time %s is negative", self.SettleTime))
+	}
+	if self.PollInterval < 0 {
+		return errors.New(fmt.Sprintf("poll interval %s is negative", self.PollInterval))
+	}
+	for _, suffix := range self.StagingSuffixes {
+		if suffix == "" || strings.Contains(suffix, "/") {
+			return errors.New(fmt.Sprintf("invalid staging suffix %q", suffix))
+		}
+	}
+	return self.validateFilters()
+}
+
+// unstaged returns the name a file being written under a staging suffix will be published
+// as, or "" if it's not a staging file.
+func (self WatcherOptions) unstaged(name string) string {
+	for _, suffix := range self.StagingSuffixes {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return name[:len(name)-len(suffix)]
+		}
+	}
+	return ""
+}
+
 // Watcher is instantiated for each directory we're serving files for.
 type Watcher struct {
-	Watcher     *fsnotify.Watcher
+	Watcher     *fsnotify.Watcher // nil if we're only polling.
+	closeWrites *closeWatcher     // nil unless files settle, on Linux, and we're not polling.
 	Directory   string
 	Files       map[string]*File // FQFN as key.
+	Dirs        map[string]*File // Directory torrents, path relative to Directory as key.
 	FilesLock   sync.Mutex
-	QuitChannel chan bool
+	QuitChannel chan bool // Closed when the watcher is closed.
+	closeOnce   sync.Once
+
+	// How metadata is generated for our files.
+	MetadataOptions MetadataOptions
+
+	// If set, files are sent here whenever their metadata becomes ready.
+	MetadataReady chan *File
+
+	// If set, the info_hashes of our files are kept here as their metadata is generated.
+	Registry *Registry
+
+	// Which files we publish, and when.
+	Options WatcherOptions
+
+	// Files waiting for their SettleTime to pass before they're hashed, and the files that
+	// staging files were just renamed to (guarded by FilesLock).
+	settling     map[string]*settlingFile
+	settlingLock sync.Mutex
+	staged       map[string]bool
+
+	// Set (atomically) once we're scanning for changes; see poll.go.
+	polling  int32
+	pollOnce sync.Once
+
+	// Files currently being hashed by a metadataGenerator, and the ones that changed again
+	// while that was happening and need another look.
+	hashing     map[string]bool
+	rehash      map[string]bool
+	hashingLock sync.Mutex
+}
+
+// settlingFile is a file waiting to be hashed until it stops changing.
+type settlingFile struct {
+	size    int64
+	modTime time.Time
+	changed time.Time // When we last saw the size or modification time change.
+	timer   *time.Timer
 }
 
-// File represents a single file that we are serving. These are read by other parts of the system
+// File represents a single file that we are serving, or a directory served as a multi-file
+// torrent (in which case FQFN is the directory). These are read by other parts of the system
 // but only written by this module.
 type File struct {
+	HashedBytes  int64         // Bytes hashed so far, while generating metadata. Atomic.
+	HashTotal    int64         // Bytes to hash in total; 0 when not hashing. Atomic.
 	Name         string        // Base filename.
 	FQFN         string        // Path + filename.
 	Size         int64         // File size.
 	ModTime      time.Time     // Modification time.
 	MetadataInfo *MetadataInfo // Reference to our metadata.
-	SeedCommand  *exec.Cmd     // Owned by the Tracker methods.
 	Lock         sync.Mutex
 }
 
+// HashProgress returns how far along metadata generation is for the file. total is 0 if
+// it's not being generated right now.
+func (self *File) HashProgress() (hashed, total int64) {
+	return atomic.LoadInt64(&self.HashedBytes), atomic.LoadInt64(&self.HashTotal)
+}
+
+// startHashing resets the progress counters and returns the metadata options to hash size
+// bytes of this file with, which update the counters as they go.
+func (self *File) startHashing(options MetadataOptions, size int64) MetadataOptions {
+	atomic.StoreInt64(&self.HashedBytes, 0)
+	atomic.StoreInt64(&self.HashTotal, size*options.passes())
+	progress := options.Progress
+	options.Progress = func(bytes int64) {
+		atomic.AddInt64(&self.HashedBytes, bytes)
+		if progress != nil {
+			progress(bytes)
+		}
+	}
+	return options
+}
+
+// doneHashing clears the progress counters.
+func (self *File) doneHashing() {
+	atomic.StoreInt64(&self.HashTotal, 0)
+	atomic.StoreInt64(&self.HashedBytes, 0)
+}
+
 // GetFile returns, given a full path filename, either a pointer to a valid file structure or a
 // nil if there is no file with that name.
 func (self *Watcher) GetFile(name string) *File {
@@ -49,6 +193,23 @@ func (self *Watcher) GetFile(name string) *File {
 	return self.Files[name]
 }
 
+// requestPath returns the path clients request a file (or directory) by, when we're called
+// name.
+func (self *Watcher) requestPath(name string, file *File) string {
+	return name + "/" + strings.TrimPrefix(file.FQFN, self.Directory+"/")
+}
+
+// serves says whether file is one of the files or directories we're serving right now, rather
+// than one we've since replaced, deleted or purged.
+func (self *Watcher) serves(file *File) bool {
+	localfn := strings.TrimPrefix(file.FQFN, self.Directory+"/")
+
+	self.FilesLock.Lock()
+	defer self.FilesLock.Unlock()
+
+	return self.Files[localfn] == file || self.Dirs[localfn] == file
+}
+
 // GetFiles returns a list of all files in this directory; if no files exist, returns an empty list
 func (self *Watcher) GetFiles() []*File {
 	self.FilesLock.Lock()
@@ -61,66 +222,368 @@ func (self *Watcher) GetFiles() []*File {
 	return files
 }
 
-func (self *Watcher) metadataGenerator(metaChannel chan string) {
-	// Some assumptions: We are the only writer to ever touch the Metadata record in any
-	// File object globally. We take a lock to get the file and before we do any manipulation
-	// of the structures, but otherwise we do NOT lock during the metadata generation stage since
-	// it can take a while.
-	for {
-		localfn := <-metaChannel
-		file := self.GetFile(localfn)
-		if file == nil {
-			continue
+// GetDir returns the multi-file torrent for a subdirectory, relative to the watched directory.
+// Metadata generation is started the first time a directory is asked for, so the result may
+// not have metadata yet. Returns nil if we're not serving any files under that directory.
+func (self *Watcher) GetDir(subdir string) *File {
+	subdir = filepath.Clean(subdir)
+	if subdir == "." || subdir == ".." || filepath.IsAbs(subdir) ||
+		strings.HasPrefix(subdir, "../") {
+		return nil
+	}
+
+	self.FilesLock.Lock()
+	defer self.FilesLock.Unlock()
+
+	if dir := self.Dirs[subdir]; dir != nil {
+		return dir
+	}
+	if len(self.dirPaths(subdir)) == 0 {
+		return nil
+	}
+
+	LogDebug("Directory torrent requested: %s", subdir)
+	dir := &File{
+		Name: filepath.Base(subdir),
+		FQFN: filepath.Join(self.Directory, subdir),
+	}
+	self.Dirs[subdir] = dir
+	go self.dirMetadataGenerator(subdir, dir)
+	return dir
+}
+
+// GetDirs returns all of the directory torrents that have been requested.
+func (self *Watcher) GetDirs() []*File {
+	self.FilesLock.Lock()
+	defer self.FilesLock.Unlock()
+
+	var dirs []*File
+	for _, value := range self.Dirs {
+		dirs = append(dirs, value)
+	}
+	return dirs
+}
+
+// dirPaths returns the sorted paths, relative to subdir, of the files we serve under it. Must
+// be called with FilesLock held.
+func (self *Watcher) dirPaths(subdir string) []string {
+	var paths []string
+	for localfn := range self.Files {
+		if strings.HasPrefix(localfn, subdir+"/") {
+			paths = append(paths, localfn[len(subdir)+1:])
 		}
+	}
+	sort.Strings(paths)
+	return paths
+}
 
-		info, err := os.Stat(file.FQFN)
+// dirState describes the size and modification time of all the files in a directory torrent,
+// so we can tell if any of them changed while we were hashing.
+func dirState(dir string, paths []string) string {
+	var state bytes.Buffer
+	for _, path := range paths {
+		info, err := os.Stat(filepath.Join(dir, path))
 		if err != nil {
-			LogError("Failed to stat %s: %s", file.FQFN, err)
-			continue
+			return ""
 		}
+		fmt.Fprintf(&state, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+	}
+	return state.String()
+}
 
-		// If we already have metadata, we also want to check if the file hasn't been modified
-		file.Lock.Lock()
-		if file.MetadataInfo != nil && file.ModTime == info.ModTime() && file.Size == info.Size() {
-			file.Lock.Unlock()
-			continue
+// dirSize adds up the sizes of the files in a directory torrent, for progress reporting.
+func dirSize(dir string, paths []string) int64 {
+	total := int64(0)
+	for _, path := range paths {
+		if info, err := os.Stat(filepath.Join(dir, path)); err == nil {
+			total += info.Size()
 		}
-		file.Lock.Unlock()
+	}
+	return total
+}
 
-		mdinfo, err := GenerateMetadataInfo(file.FQFN)
-		if err != nil {
-			LogError("Failed to generate metadata: %s", err)
-			continue
+// dirMetadataGenerator builds the metadata for a directory torrent. It's retried a few times
+// if files change while it runs; if it can't succeed, the directory is forgotten so the next
+// request starts over.
+func (self *Watcher) dirMetadataGenerator(subdir string, dir *File) {
+	for tries := 0; tries < 10; tries++ {
+		if tries > 0 {
+			time.Sleep(1 * time.Second)
 		}
 
-		info2, err := os.Stat(file.FQFN)
+		self.FilesLock.Lock()
+		paths := self.dirPaths(subdir)
+		self.FilesLock.Unlock()
+
+		before := dirState(dir.FQFN, paths)
+		options := dir.startHashing(self.MetadataOptions.forPath(subdir),
+			dirSize(dir.FQFN, paths))
+		mdinfo, err := GenerateDirMetadataInfo(dir.FQFN, paths, options)
+		dir.doneHashing()
 		if err != nil {
-			LogError("Failed to stat %s: %s", file.FQFN, err)
+			LogError("Failed to generate metadata for %s: %s", subdir, err)
+			continue
+		}
+		if mdinfo == nil || before == "" || before != dirState(dir.FQFN, paths) {
+			LogDebug("Directory %s changed while generating metadata, retrying.", subdir)
 			continue
 		}
 
-		if info.Size() != info2.Size() || info.ModTime() != info2.ModTime() {
-			LogError("File changed while generating metadata. Ignoring results and waiting for next event.")
+		self.register(dir, mdinfo, func() bool { return self.Dirs[subdir] == dir })
+		dir.Lock.Lock()
+		dir.MetadataInfo = mdinfo
+		dir.Lock.Unlock()
+		return
+	}
+
+	LogError("Giving up on metadata for directory %s.", subdir)
+	self.FilesLock.Lock()
+	if self.Dirs[subdir] == dir {
+		delete(self.Dirs, subdir)
+	}
+	self.FilesLock.Unlock()
+}
+
+// register adds a file's new metadata to our registry, if we have one. That's done before the
+// metadata is published, so the tracker knows the info_hash by the time anyone can announce
+// it. tracked (called with FilesLock held) says whether we still have the file; if it went away
+// while we were hashing it, it's unregistered again.
+func (self *Watcher) register(file *File, mdinfo *MetadataInfo, tracked func() bool) {
+	if self.Registry == nil {
+		return
+	}
+	if err := self.Registry.Register(file, mdinfo); err != nil {
+		LogError("Failed to register %s: %s", file.FQFN, err)
+		return
+	}
+	self.FilesLock.Lock()
+	defer self.FilesLock.Unlock()
+	if !tracked() {
+		self.Registry.Unregister(file)
+	}
+}
+
+// unregister removes a file from our registry, if we have one.
+func (self *Watcher) unregister(file *File) {
+	if self.Registry != nil && file != nil {
+		self.Registry.Unregister(file)
+	}
+}
+
+// claimHashing marks a file as being hashed. If another generator already has it, the file is
+// flagged to be looked at again once that's done, and false is returned.
+func (self *Watcher) claimHashing(localfn string) bool {
+	self.hashingLock.Lock()
+	defer self.hashingLock.Unlock()
+
+	if self.hashing[localfn] {
+		self.rehash[localfn] = true
+		return false
+	}
+	self.hashing[localfn] = true
+	return true
+}
+
+// releaseHashing is called when a generator is done with a file. It returns whether the file
+// changed in the meantime and needs to be checked again.
+func (self *Watcher) releaseHashing(localfn string) bool {
+	self.hashingLock.Lock()
+	defer self.hashingLock.Unlock()
+
+	again := self.rehash[localfn]
+	delete(self.hashing, localfn)
+	delete(self.rehash, localfn)
+	return again
+}
+
+func (self *Watcher) metadataGenerator(metaChannel chan string) {
+	// Some assumptions: We are the only writer to ever touch the Metadata record in any
+	// File object globally. We take a lock to get the file and before we do any manipulation
+	// of the structures, but otherwise we do NOT lock during the metadata generation stage since
+	// it can take a while. Several of these run at once, but never on the same file.
+	for {
+		var localfn string
+		select {
+		case localfn = <-metaChannel:
+		case <-self.QuitChannel:
+			return
+		}
+		if !self.claimHashing(localfn) {
 			continue
 		}
+		self.generateMetadata(localfn)
+		if self.releaseHashing(localfn) {
+			// Don't block on our own channel; it may be full.
+			go func() { metaChannel <- localfn }()
+		}
+	}
+}
 
-		file.Size = info.Size()
-		file.ModTime = info.ModTime()
-		file.Lock.Lock()
-		file.MetadataInfo = mdinfo
+// generateMetadata (re)builds the metadata for one file, if it has changed.
+func (self *Watcher) generateMetadata(localfn string) {
+	file := self.GetFile(localfn)
+	if file == nil {
+		return
+	}
+
+	info, err := os.Stat(file.FQFN)
+	if err != nil {
+		LogError("Failed to stat %s: %s", file.FQFN, err)
+		return
+	}
+
+	// If we already have metadata, we also want to check if the file hasn't been modified
+	file.Lock.Lock()
+	if file.MetadataInfo != nil && file.ModTime == info.ModTime() && file.Size == info.Size() {
 		file.Lock.Unlock()
+		return
+	}
+	file.Lock.Unlock()
+
+	options := file.startHashing(self.MetadataOptions.forPath(localfn), info.Size())
+	mdinfo, err := GenerateMetadataInfo(file.FQFN, options)
+	file.doneHashing()
+	if err != nil {
+		LogError("Failed to generate metadata: %s", err)
+		return
+	}
+
+	info2, err := os.Stat(file.FQFN)
+	if err != nil {
+		LogError("Failed to stat %s: %s", file.FQFN, err)
+		return
+	}
+
+	if info.Size() != info2.Size() || info.ModTime() != info2.ModTime() {
+		LogError("File changed while generating metadata. Ignoring results and waiting for next event.")
+		return
+	}
+
+	if mdinfo != nil {
+		self.register(file, mdinfo, func() bool { return self.Files[localfn] == file })
+	} else {
+		self.unregister(file) // It's empty now, so there's nothing to download.
+	}
+	file.Lock.Lock()
+	file.Size = info.Size()
+	file.ModTime = info.ModTime()
+	file.MetadataInfo = mdinfo
+	file.Lock.Unlock()
+
+	if mdinfo != nil && self.MetadataReady != nil && !self.closed() {
+		self.MetadataReady <- file
+	}
+}
+
+// closeWrite is the Op of events for files that were closed after being written, which fsnotify
+// doesn't report; see closewrite_linux.go. It's a bit fsnotify doesn't use.
+const closeWrite fsnotify.Op = 1 << 31
+
+// settle sends a file to be hashed once its size and modification time have stayed the same for
+// Options.SettleTime, or straight away if that's 0 or now is set. A file we haven't seen before
+// counts as unchanged since its modification time, so files that were already there when we
+// started don't have to wait.
+func (self *Watcher) settle(localfn string, now bool, metaChannel chan string) {
+	if self.Options.SettleTime <= 0 || now {
+		self.unsettle(localfn)
+		metaChannel <- localfn
+		return
+	}
+	info, err := os.Stat(filepath.Join(self.Directory, localfn))
+	if err != nil {
+		return // It's gone again; we'll hear about that.
+	}
+
+	self.settlingLock.Lock()
+	ready := false
+	entry := self.settling[localfn]
+	if entry == nil {
+		changed := info.ModTime()
+		if changed.After(time.Now()) {
+			changed = time.Now()
+		}
+		if wait := self.Options.SettleTime - time.Since(changed); wait <= 0 {
+			ready = true
+		} else {
+			LogDebug("Waiting for %s to settle.", localfn)
+			entry = &settlingFile{size: info.Size(), modTime: info.ModTime(), changed: changed}
+			entry.timer = time.AfterFunc(wait, func() { self.settled(localfn, metaChannel) })
+			self.settling[localfn] = entry
+		}
+	} else if entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		entry.size, entry.modTime, entry.changed = info.Size(), info.ModTime(), time.Now()
+		entry.timer.Reset(self.Options.SettleTime)
+	}
+	self.settlingLock.Unlock()
+
+	// Not while holding settlingLock, in case metaChannel is full.
+	if ready {
+		metaChannel <- localfn
+	}
+}
+
+// settled is called when a file's SettleTime may have passed. If the file changed since we last
+// looked, it waits some more, otherwise it's sent to be hashed.
+func (self *Watcher) settled(localfn string, metaChannel chan string) {
+	info, err := os.Stat(filepath.Join(self.Directory, localfn))
+
+	self.settlingLock.Lock()
+	entry := self.settling[localfn]
+	if entry == nil || err != nil || self.closed() {
+		delete(self.settling, localfn)
+		self.settlingLock.Unlock()
+		return
+	}
+	if entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		entry.size, entry.modTime, entry.changed = info.Size(), info.ModTime(), time.Now()
+	}
+	if wait := self.Options.SettleTime - time.Since(entry.changed); wait > 0 {
+		entry.timer.Reset(wait)
+		self.settlingLock.Unlock()
+		return
+	}
+	delete(self.settling, localfn)
+	self.settlingLock.Unlock()
+
+	LogDebug("File settled: %s", localfn)
+	select {
+	case metaChannel <- localfn:
+	case <-self.QuitChannel:
 	}
 }
 
-func (self *Watcher) updateChannelHandler(updates chan string) {
-	// The watcher is also responsible for (single-threadedly) generating metadata information
-	// for files. This is done in such a way as to make it so that files aren't available until
+// unsettle stops waiting for a file to settle, because it's gone or is being hashed anyway.
+func (self *Watcher) unsettle(localfn string) {
+	self.settlingLock.Lock()
+	defer self.settlingLock.Unlock()
+
+	if entry := self.settling[localfn]; entry != nil {
+		entry.timer.Stop()
+		delete(self.settling, localfn)
+	}
+}
+
+func (self *Watcher) updateChannelHandler(updates chan fsnotify.Event) {
+	// The watcher is also responsible for generating metadata information for files, a few at
+	// a time. This is done in such a way as to make it so that files aren't available until
 	// the metadata is done.
 	metaChannel := make(chan string, 10000)
-	go self.metadataGenerator(metaChannel)
+	concurrency := self.MetadataOptions.Concurrency
+	if concurrency < 1 {
+		concurrency = HASH_CONCURRENCY
+	}
+	for i := 0; i < concurrency; i++ {
+		go self.metadataGenerator(metaChannel)
+	}
 
 	for {
-		fqfn := <-updates
+		var ev fsnotify.Event
+		select {
+		case ev = <-updates:
+		case <-self.QuitChannel:
+			return
+		}
+		fqfn := ev.Name
 
 		// We don't handle the watched dir itself.
 		if fqfn == self.Directory {
@@ -132,7 +595,8 @@ func (self *Watcher) updateChannelHandler(updates chan string) {
 			continue
 		}
 		localfn := fqfn[len(self.Directory)+1:]
-		requestMetadata := false
+		requestMetadata, renamed := false, false
+		closed := ev.Op&closeWrite != 0
 
 		func() {
 			self.FilesLock.Lock()
@@ -142,21 +606,54 @@ func (self *Watcher) updateChannelHandler(updates chan string) {
 			_, isTracking := self.Files[localfn]
 			name := filepath.Base(fqfn)
 
-			if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".mdcache") {
+			if strings.HasPrefix(name, ".") || isCacheFile(name) {
 				// Ignore hidden and metadata cache files
 				return
 			}
 
+			// Files still being written under a staging name aren't served. When one's renamed,
+			// the file it was renamed to should be the next thing we hear about.
+			if final := self.Options.unstaged(localfn); final != "" {
+				if ev.Op&fsnotify.Rename != 0 {
+					self.staged[final] = true
+				}
+				return
+			}
+			renamed = self.staged[localfn]
+			delete(self.staged, localfn)
+
+			// Files we don't serve are treated as if they weren't there.
+			if info != nil && !self.wanted(localfn, info) {
+				info = nil
+			}
+			if info == nil && !isTracking {
+				return
+			}
+
+			// Any change to a file invalidates the directory torrents containing it.
+			for subdir := range self.Dirs {
+				if strings.HasPrefix(localfn, subdir+"/") {
+					LogDebug("Directory changed: %s", subdir)
+					self.unregister(self.Dirs[subdir])
+					delete(self.Dirs, subdir)
+				}
+			}
+
 			if isTracking && info == nil {
 				// Deleted files.
 				LogDebug("File removed: %s", fqfn)
+				self.unregister(self.Files[localfn])
+				self.unsettle(localfn)
 				delete(self.Files, localfn)
+				self.MetadataOptions.removeCache(fqfn)
 			} else if info != nil {
 				if !isTracking {
 					// New file found, watch it or add it to our list.
 					if info.IsDir() {
 						// Directories get walked, files just get added.
 						go self.walkAndWatch(fqfn, updates)
+					} else if len(self.Options.StagingSuffixes) > 0 && ev.Op != 0 && !renamed {
+						LogDebug("Ignoring %s: it wasn't renamed from a staging file.", localfn)
 					} else {
 						LogDebug("File discovered: %s", localfn)
 						self.Files[localfn] = &File{
@@ -176,71 +673,240 @@ func (self *Watcher) updateChannelHandler(updates chan string) {
 		// This has to happen late like this instead of above since otherwise we might end up
 		// with deadlock with the metadata generator.
 		if requestMetadata {
-			metaChannel <- localfn
+			self.settle(localfn, renamed || closed, metaChannel)
 		}
 	}
 }
 
-func (self *Watcher) walkAndWatch(dir string, updates chan string) {
+// walkAndWatch watches dir and everything under it that we want. The files in it are sent to
+// updates as events with no Op, since they were found rather than changed. If we're polling, or
+// something couldn't be watched, the poller is started once we're done.
+func (self *Watcher) walkAndWatch(dir string, updates chan fsnotify.Event) {
 	LogDebug("Walking directory: %s", dir)
-	filepath.Walk(dir, func(fqfn string, info os.FileInfo, err error) error {
+	self.walk(dir, true, func(fqfn string) bool {
+		select {
+		case updates <- fsnotify.Event{Name: fqfn}:
+			return true
+		case <-self.QuitChannel:
+			return false
+		}
+	})
+	if self.isPolling() && !self.closed() {
+		self.startPolling(updates)
+	}
+}
+
+// walk calls found with every file under dir, watching the directories on the way if watch is
+// set. Unlike filepath.Walk, it follows symlinks (wanted says which) and skips the directories
+// we don't want. It returns false if it was stopped, by found or by the watcher closing.
+func (self *Watcher) walk(dir string, watch bool, found func(fqfn string) bool) bool {
+	return self.walkDir(dir, watch, make(map[string]bool), found)
+}
+
+// walkDir is walk, remembering where the directories it's been in really are. Symlinks to any
+// of them aren't followed, since links between directories can lead back to where we started.
+func (self *Watcher) walkDir(dir string, watch bool, visited map[string]bool,
+	found func(fqfn string) bool) bool {
+	if self.closed() {
+		return false
+	}
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		link, err := os.Lstat(dir)
+		if err == nil && link.Mode()&os.ModeSymlink != 0 && visited[real] {
+			LogError("Not following %s: it links to %s, which we've been in already.", dir, real)
+			return true
+		}
+		visited[real] = true
+	}
+	if watch && !self.isPolling() {
+		LogInfo("Watching directory: %s", dir)
+		if err := self.Watcher.Add(dir); err != nil {
+			if self.closed() {
+				return false
+			}
+			LogError("Failed to watch %s, scanning for changes instead: %s", dir, err)
+			atomic.StoreInt32(&self.polling, 1)
+		} else if self.closeWrites != nil {
+			if err := self.closeWrites.Add(dir); err != nil && !self.closed() {
+				LogError("Failed to watch %s for closed files, letting them settle: %s", dir, err)
+			}
+		}
+	}
+
+	handle, err := os.Open(dir)
+	if err != nil {
+		LogError("Failed to read directory %s: %s", dir, err)
+		return true
+	}
+	names, err := handle.Readdirnames(-1)
+	handle.Close()
+	if err != nil {
+		LogError("Failed to read directory %s: %s", dir, err)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") {
+			continue // Hidden files and directories are never served.
+		}
+		fqfn := filepath.Join(dir, name)
+		info, err := os.Stat(fqfn)
 		if err != nil {
-			return err
+			continue // Gone already, or a broken symlink.
 		}
-		if info.IsDir() {
-			LogInfo("Watching directory: %s", fqfn)
-			if err := self.Watcher.Add(fqfn); err != nil {
-				LogFatal("Watch: %s", err)
+		if !info.IsDir() {
+			if !found(fqfn) {
+				return false
+			}
+		} else if self.wanted(fqfn[len(self.Directory)+1:], info) {
+			if !self.walkDir(fqfn, watch, visited, found) {
+				return false
 			}
-		} else {
-			updates <- fqfn
 		}
-		return nil
+	}
+	return true
+}
+
+// pruneCache removes caches for files that were deleted while we weren't watching.
+func (self *Watcher) pruneCache() {
+	if self.MetadataOptions.CacheDir == "" {
+		return
+	}
+	var files []string
+	self.walk(self.Directory, false, func(fqfn string) bool {
+		files = append(files, fqfn[len(self.Directory)+1:])
+		return true
 	})
+	self.MetadataOptions.pruneCacheDir(files)
 }
 
 func (self *Watcher) watch() {
 	// Set up our change channel. This is sent notifications whenever a file event has happened,
 	// and it's responsible for updating local status.
-	updateChannel := make(chan string, 1000)
+	updateChannel := make(chan fsnotify.Event, 1000)
 	go self.updateChannelHandler(updateChannel)
 
 	// Walks a directory and watches everything in it.
 	self.walkAndWatch(self.Directory, updateChannel)
-
-	// This is the main goroutine that actually processes events.
+	go self.pruneCache()
+
+	// This is the main goroutine that actually processes events. If we're only polling there
+	// aren't any, and these channels stay nil.
+	var events, closes chan fsnotify.Event
+	var errs chan error
+	if self.Watcher != nil {
+		events, errs = self.Watcher.Events, self.Watcher.Errors
+	}
+	if self.closeWrites != nil {
+		closes = self.closeWrites.Events
+	}
 	for {
 		select {
-		case ev := <-self.Watcher.Events:
+		case ev := <-events:
 			// Regardless of what the event is, just let the update channel know something has
 			// updated. It can infer what it needs to do based on the present state.
-			updateChannel <- ev.Name
-		case err := <-self.Watcher.Errors:
+			updateChannel <- ev
+		case ev := <-closes:
+			updateChannel <- ev
+		case err := <-errs:
 			// Should this be exiting the loop??
 			LogError("Watcher error: %s", err)
+			if err == fsnotify.ErrEventOverflow {
+				// Events were lost, and will be again, so we look for ourselves.
+				self.startPolling(updateChannel)
+			}
 		case _ = <-self.QuitChannel:
+			if self.Watcher != nil {
+				self.Watcher.Close()
+			}
+			if self.closeWrites != nil {
+				self.closeWrites.Close()
+			}
 			return
 		}
 	}
 }
 
+// Close stops watching. Files being hashed are finished, but nothing is done with them.
 func (w *Watcher) Close() {
-	w.QuitChannel <- true
+	w.closeOnce.Do(func() { close(w.QuitChannel) })
 }
 
-// startWatcher creates a watcher for a given directory and starts watching it.
-func StartWatcher(dir string) *Watcher {
-	// Set up fsnotify watcher.
-	fswatcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		LogFatal("NewWatcher: %s", err)
+// closed says whether the watcher has been closed.
+func (self *Watcher) closed() bool {
+	select {
+	case <-self.QuitChannel:
+		return true
+	default:
+		return false
 	}
+}
 
+// purge forgets every file, and their metadata, once the watcher is closed. Returns the files
+// it forgot.
+func (self *Watcher) purge() []*File {
+	self.FilesLock.Lock()
+	defer self.FilesLock.Unlock()
+
+	files := make([]*File, 0, len(self.Files)+len(self.Dirs))
+	for _, file := range self.Files {
+		files = append(files, file)
+	}
+	for _, dir := range self.Dirs {
+		files = append(files, dir)
+	}
+	for _, file := range files {
+		self.unregister(file)
+		self.unsettle(strings.TrimPrefix(file.FQFN, self.Directory+"/"))
+		file.Lock.Lock()
+		file.MetadataInfo = nil
+		file.Lock.Unlock()
+	}
+	self.Files = make(map[string]*File)
+	self.Dirs = make(map[string]*File)
+	return files
+}
+
+// startWatcher creates a watcher for a given directory and starts watching it. If ready is not
+// nil, files are sent to it as their metadata is generated, and if registry is not nil, their
+// info_hashes are recorded there.
+func StartWatcher(dir string, options MetadataOptions, woptions WatcherOptions,
+	ready chan *File, registry *Registry) *Watcher {
+	// Set up fsnotify watcher, unless we're polling.
+	var fswatcher *fsnotify.Watcher
+	if woptions.PollInterval <= 0 {
+		var err error
+		if fswatcher, err = fsnotify.NewWatcher(); err != nil {
+			LogError("Failed to watch %s, scanning for changes instead: %s", dir, err)
+		}
+	}
+	var closeWrites *closeWatcher
+	if fswatcher != nil && woptions.SettleTime > 0 {
+		var err error
+		if closeWrites, err = newCloseWatcher(); err != nil {
+			LogDebug("Not watching %s for closed files: %s", dir, err)
+		}
+	}
+
+	options.cacheRoot = dir
 	watcher := &Watcher{
-		Watcher:     fswatcher,
-		Directory:   dir,
-		Files:       make(map[string]*File),
-		QuitChannel: make(chan bool),
+		Watcher:         fswatcher,
+		closeWrites:     closeWrites,
+		Directory:       dir,
+		Files:           make(map[string]*File),
+		Dirs:            make(map[string]*File),
+		QuitChannel:     make(chan bool),
+		MetadataOptions: options,
+		MetadataReady:   ready,
+		Registry:        registry,
+		Options:         woptions,
+		settling:        make(map[string]*settlingFile),
+		staged:          make(map[string]bool),
+		hashing:         make(map[string]bool),
+		rehash:          make(map[string]bool),
+	}
+	if fswatcher == nil {
+		watcher.polling = 1
 	}
 	go watcher.watch()
 
@@ -0,0 +1,85 @@
+package torrent
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcherOptionsValidate(t *testing.T) {
+	assert.Nil(t, DefaultWatcherOptions.Validate())
+	assert.Nil(t, WatcherOptions{SettleTime: time.Second,
+		StagingSuffixes: []string{".part", ".tmp"}}.Validate())
+	assert.NotNil(t, WatcherOptions{SettleTime: -time.Second}.Validate())
+	assert.NotNil(t, WatcherOptions{StagingSuffixes: []string{""}}.Validate())
+	assert.NotNil(t, WatcherOptions{StagingSuffixes: []string{"a/.part"}}.Validate())
+
+	options := WatcherOptions{StagingSuffixes: []string{".part"}}
+	assert.Equal(t, "dir/file", options.unstaged("dir/file.part"))
+	assert.Equal(t, "", options.unstaged("dir/file"))
+	assert.Equal(t, "", options.unstaged(".part"))
+}
+
+func newTestWatcher(t *testing.T, options WatcherOptions) (string, *Watcher, chan *File) {
+	dir, err := ioutil.TempDir("", "distributor-test")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "old"), []byte("old"), 0644))
+	// Files that were already there when we start don't have to settle.
+	hourAgo := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "old"), hourAgo, hourAgo))
+	ready := make(chan *File, 100)
+	watcher := StartWatcher(dir, DefaultMetadataOptions, options, ready, nil)
+	assert.Equal(t, "old", (<-ready).Name)
+	return dir, watcher, ready
+}
+
+func TestWatcherSettleTime(t *testing.T) {
+	settle := 300 * time.Millisecond
+	dir, watcher, ready := newTestWatcher(t, WatcherOptions{SettleTime: settle})
+	defer os.RemoveAll(dir)
+	defer watcher.Close()
+
+	// A file that keeps being written to isn't published until it's left alone. (It's kept
+	// open, since closing it would publish it straight away on Linux.)
+	output, err := os.Create(filepath.Join(dir, "new"))
+	assert.Nil(t, err)
+	defer output.Close()
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		output.Write([]byte("data"))
+		time.Sleep(100 * time.Millisecond)
+	}
+	file := <-ready
+	assert.Equal(t, "new", file.Name)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond+settle)
+	assert.Equal(t, int64(20), file.Size)
+}
+
+func TestWatcherStagingSuffixes(t *testing.T) {
+	dir, watcher, ready := newTestWatcher(t, WatcherOptions{
+		SettleTime:      time.Hour,
+		StagingSuffixes: []string{".part"},
+	})
+	defer os.RemoveAll(dir)
+	defer watcher.Close()
+
+	// Files written in place are ignored, as are staging files.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "inplace"), []byte("data"), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "new.part"), []byte("data"), 0644))
+
+	// Renaming a staging file into place publishes it straight away, despite the settle time.
+	assert.Nil(t, os.Rename(filepath.Join(dir, "new.part"), filepath.Join(dir, "new")))
+	select {
+	case file := <-ready:
+		assert.Equal(t, "new", file.Name)
+	case <-time.After(10 * time.Second):
+		t.Fatal("renamed file wasn't published")
+	}
+	assert.Nil(t, watcher.GetFile("inplace"))
+	assert.Nil(t, watcher.GetFile("new.part"))
+	assert.NotNil(t, watcher.GetFile("new"))
+}